@@ -47,3 +47,29 @@ var (
 	NewSecretGeneratorPlugin                = internal.NewSecretGeneratorPlugin
 	NewValueAddTransformerPlugin            = internal.NewValueAddTransformerPlugin
 )
+
+// Tracer and Span time the phases of a PatchTransformerPlugin,
+// as set by its SetTracer.
+type (
+	Tracer = internal.Tracer
+	Span   = internal.Span
+)
+
+// The results that a PatchTransformerPlugin reports of its patch.
+type (
+	BlastReport = internal.BlastReport
+	Conflict    = internal.Conflict
+	Finding     = internal.Finding
+	PatchDiff   = internal.PatchDiff
+	Severity    = internal.Severity
+)
+
+const (
+	SeverityInfo  = internal.SeverityInfo
+	SeverityWarn  = internal.SeverityWarn
+	SeverityError = internal.SeverityError
+)
+
+// ApplyToAll applies each of the PatchTransformerPlugins across all
+// of the ResMaps, for tooling that builds components separately.
+var ApplyToAll = internal.ApplyToAll
@@ -4,16 +4,36 @@
 package builtins
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	"sigs.k8s.io/kustomize/api/filters/fieldspec"
 	"sigs.k8s.io/kustomize/api/filters/patchjson6902"
+	"sigs.k8s.io/kustomize/api/ifc"
 	"sigs.k8s.io/kustomize/api/resmap"
 	"sigs.k8s.io/kustomize/api/resource"
 	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/comments"
 	"sigs.k8s.io/kustomize/kyaml/errors"
 	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/openapi"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+	"sigs.k8s.io/kustomize/kyaml/utils"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+	"sigs.k8s.io/kustomize/kyaml/yaml/merge2"
+	"sigs.k8s.io/kustomize/kyaml/yaml/walk"
 	"sigs.k8s.io/yaml"
 )
 
@@ -24,38 +44,432 @@ type PatchTransformerPlugin struct {
 	patchText string
 	// patchSource is patch source message
 	patchSource string
-	Path        string          `json:"path,omitempty"    yaml:"path,omitempty"`
-	Patch       string          `json:"patch,omitempty"   yaml:"patch,omitempty"`
-	Target      *types.Selector `json:"target,omitempty"  yaml:"target,omitempty"`
-	Options     map[string]bool `json:"options,omitempty" yaml:"options,omitempty"`
+	// capabilities is the set of APIs available on the target cluster,
+	// as injected by SetCapabilities.
+	capabilities map[string]bool
+	// notes records informational messages produced while transforming,
+	// e.g. why the patch was skipped.
+	notes []string
+	// elementOrders maps a strategic-merge patch to a copy of it that
+	// retains the $setElementOrder directives stripped from the patch.
+	elementOrders map[*resource.Resource]*kyaml.RNode
+	// fieldConflicts maps the id of each patched resource to the scalar
+	// fields the patch overrode, when reportFieldConflicts is set.
+	fieldConflicts map[string][]Conflict
+	// modified lists, in order of first application, the resources
+	// the patch was applied to; isModified indexes the same.
+	modified   []*resource.Resource
+	isModified map[*resource.Resource]bool
+	// originals maps each resource the patch is applied to
+	// to a copy of the resource taken before the first application.
+	originals map[*resource.Resource]*kyaml.RNode
+	// elementPatch is the patch merged into each list element
+	// named by MergeIntoEach.
+	elementPatch *kyaml.RNode
+	// targetOptions maps each resource matched by an entry of
+	// PerTargetOptions to the options that entry overrides.
+	targetOptions map[*resource.Resource]map[string]bool
+	// findings holds what the validations found, in order.
+	findings []Finding
+	// skipped maps the id of each resource the patch targeted but left
+	// as it was to the reason it did.
+	skipped map[resid.ResId]string
+	// chainTarget is the selector of TargetChain that Transform chose.
+	chainTarget *types.Selector
+	// namePattern is NamePattern compiled, anchored to match whole names.
+	namePattern *regexp.Regexp
+	// maps holds the ResMaps last transformed.
+	maps []resmap.ResMap
+	// tracer, if set by SetTracer, records spans of the phases
+	// of configuring and transforming.
+	tracer Tracer
+	// schemaRegistry, if set by SetSchemaRegistry, holds the schemas
+	// that the targets and patches are checked against.
+	schemaRegistry SchemaRegistry
+	Path           string          `json:"path,omitempty"    yaml:"path,omitempty"`
+	Patch          string          `json:"patch,omitempty"   yaml:"patch,omitempty"`
+	Target         *types.Selector `json:"target,omitempty"  yaml:"target,omitempty"`
+	// Options turns behaviors of the patch on or off. Every option is off
+	// when unset but perDocument, which is on: a patch applies to each
+	// of the documents of a file it matches unless perDocument is false.
+	Options map[string]bool `json:"options,omitempty" yaml:"options,omitempty"`
+	// RequireCapabilities lists the APIs, in group/version/kind form
+	// (e.g. apps/v1/Deployment), that the target cluster must offer
+	// for the patch to apply. Transform fails if the cluster's APIs
+	// haven't been set with SetCapabilities.
+	RequireCapabilities []string `json:"requireCapabilities,omitempty" yaml:"requireCapabilities,omitempty"`
+	// CoerceTypes maps field paths, in the slash-separated form of a
+	// FieldSpec path, to the type (int, string or bool) that the field's
+	// value is coerced to in the patched resources.
+	CoerceTypes map[string]string `json:"coerceTypes,omitempty" yaml:"coerceTypes,omitempty"`
+	// MergeIntoEach, used in place of Patch or Path, merges a patch
+	// into every element of a list in each of the targets.
+	MergeIntoEach *MergeIntoEach `json:"mergeIntoEach,omitempty" yaml:"mergeIntoEach,omitempty"`
+	// RemoveListItems, used in place of Patch or Path, removes from a list
+	// in each of the targets the elements with the given field values.
+	RemoveListItems *RemoveListItems `json:"removeListItems,omitempty" yaml:"removeListItems,omitempty"`
+	// AllowedReservedAnnotations lists the annotations under a reserved
+	// prefix that the patch may set despite rejectReservedAnnotations.
+	AllowedReservedAnnotations []string `json:"allowedReservedAnnotations,omitempty" yaml:"allowedReservedAnnotations,omitempty"`
+	// PerTargetOptions overrides Options for the resources matching each
+	// entry's selector. Where entries overlap, later ones take precedence.
+	// The options of the patch as a whole, in patchWideOptions, can't be
+	// overridden.
+	PerTargetOptions []TargetOptions `json:"perTargetOptions,omitempty" yaml:"perTargetOptions,omitempty"`
+	// OversizedPatchRatio is how many times larger than its target,
+	// once serialized, a patch may be before rejectOversizedPatch
+	// rejects it. It defaults to 1.
+	OversizedPatchRatio float64 `json:"oversizedPatchRatio,omitempty" yaml:"oversizedPatchRatio,omitempty"`
+	// SyncWave, if set, is the sync wave that the modified resources
+	// are annotated with, under SyncWaveAnnotation.
+	SyncWave *int `json:"syncWave,omitempty" yaml:"syncWave,omitempty"`
+	// SyncWaveAnnotation is the annotation key for SyncWave.
+	// It defaults to argocd.argoproj.io/sync-wave.
+	SyncWaveAnnotation string `json:"syncWaveAnnotation,omitempty" yaml:"syncWaveAnnotation,omitempty"`
+	// TargetChain, used in place of Target, lists selectors to try in
+	// order: the patch applies to the resources matching the first one
+	// that matches any. Transform leaves Target unset, keeping the
+	// selector it chose internally, for ExplainSelection to explain by.
+	TargetChain []*types.Selector `json:"targetChain,omitempty" yaml:"targetChain,omitempty"`
+	// Targets, used in place of Target, lists selectors of which the
+	// patch applies to the resources matching any. A resource matching
+	// several is patched once, unless the option errorOnOverlap rejects it.
+	Targets []*types.Selector `json:"targets,omitempty" yaml:"targets,omitempty"`
+	// LoadTimeoutMs bounds, in milliseconds, the time taken to load the
+	// patch from Path, which may be a remote location. It defaults to
+	// 30 seconds.
+	LoadTimeoutMs int `json:"loadTimeoutMs,omitempty" yaml:"loadTimeoutMs,omitempty"`
+	// Environment, if set, selects the section of the patch to apply: the
+	// patch is then a map of environment names, e.g. dev and prod, each to
+	// a patch, given as YAML or as a string of it.
+	Environment string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	// PSSLevel is the Pod Security Standard, baseline or restricted,
+	// that validatePSS checks workloads against. It defaults to baseline.
+	PSSLevel string `json:"pssLevel,omitempty" yaml:"pssLevel,omitempty"`
+	// SessionAffinity is the session affinity that requireSessionAffinity
+	// requires of Services. It defaults to ClientIP.
+	SessionAffinity string `json:"sessionAffinity,omitempty" yaml:"sessionAffinity,omitempty"`
+	// MaxResultDepth is the most levels of maps and lists that
+	// maxResultDepth allows a patched resource to nest. It defaults to 32.
+	MaxResultDepth int `json:"maxResultDepth,omitempty" yaml:"maxResultDepth,omitempty"`
+	// AllowedRegistries, if set, lists where the images the patch sets
+	// on containers may come from: a registry host (e.g. gcr.io), or a
+	// prefix of the image name ending in /* (e.g. gcr.io/* or
+	// docker.io/library/*). Images on Docker Hub may omit docker.io.
+	AllowedRegistries []string `json:"allowedRegistries,omitempty" yaml:"allowedRegistries,omitempty"`
+	// NamePattern, if set, is a regular expression that the whole name of
+	// each resource the patch modified, e.g. renamed, must match.
+	NamePattern string `json:"namePattern,omitempty" yaml:"namePattern,omitempty"`
+	// RequireOwnerLabel, if set, is the key of a label, e.g. team, that
+	// each resource the patch modified must have, with a non-empty value.
+	RequireOwnerLabel string `json:"requireOwnerLabel,omitempty" yaml:"requireOwnerLabel,omitempty"`
+	// AllowedKinds, if set, lists the kinds of resources the patch may
+	// modify. Other resources it targets are left as they are, with a note.
+	AllowedKinds []string `json:"allowedKinds,omitempty" yaml:"allowedKinds,omitempty"`
+	// Group, if set, is the API group, e.g. networking.k8s.io, of the
+	// resources the patch may modify, whatever their version and kind.
+	// Other resources it targets are left as they are, with a note.
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+	// MutuallyExclusive lists groups of fields, by the slash-separated
+	// paths of FieldSpecs, of which the resources the patch modified may
+	// set at most one. The fields are grouped under each object at their
+	// common path, e.g. each volume of spec/volumes/configMap and
+	// spec/volumes/secret.
+	MutuallyExclusive [][]string `json:"mutuallyExclusive,omitempty" yaml:"mutuallyExclusive,omitempty"`
+	// SetExpr, used in place of Patch or Path, sets fields of the targets
+	// as given in query string form, e.g. spec.replicas=3&metadata.labels.tier=web.
+	// Fields are dot-separated paths, which may bracket keys holding dots,
+	// e.g. metadata.labels.[app.kubernetes.io/name]=web.
+	SetExpr string `json:"setExpr,omitempty" yaml:"setExpr,omitempty"`
+	// ApplyToPaths lists, by slash-separated paths, analogous subtrees
+	// of the targets, e.g. spec/template and spec/previousTemplate: what a
+	// strategic merge patch sets under the first is merged into each of
+	// the others the target has as well, unless the patch sets it itself.
+	// It must list at least two paths, and applies only to strategic
+	// merge patches.
+	ApplyToPaths []string `json:"applyToPaths,omitempty" yaml:"applyToPaths,omitempty"`
+	// NoColor leaves the ANSI colors out of RenderColorDiff,
+	// for output that isn't to a terminal.
+	NoColor bool `json:"noColor,omitempty" yaml:"noColor,omitempty"`
+	// Concurrency, if more than 1, is how many of its targets a JSON 6902
+	// patch is applied to at once. Strategic merge patches, which may
+	// delete their targets from the ResMap, are applied to one at a time.
+	Concurrency int `json:"concurrency,omitempty" yaml:"concurrency,omitempty"`
+	// Priority orders this transformer among those of its kustomization:
+	// transformers run by ascending priority, in listed order when equal.
+	Priority int `json:"priority,omitempty" yaml:"priority,omitempty"`
+}
+
+const (
+	defaultSyncWaveAnnotation = "argocd.argoproj.io/sync-wave"
+	defaultLoadTimeoutMs      = 30000
+	defaultMaxResultDepth     = 32
+
+	// initOrderAnnotation lists, comma-separated, the names of init
+	// containers of a workload in the order they must run.
+	initOrderAnnotation = "kustomize.config.k8s.io/init-order"
+
+	// numericMarker prefixes the numbers turned into strings, under
+	// preserveNumericStyle, while a JSON patch is applied.
+	numericMarker = "kustomize.config.k8s.io/number:"
+
+	// fieldProvenanceAnnotation maps, in JSON, the paths of the fields
+	// that patches set under annotateFieldProvenance to their sources.
+	fieldProvenanceAnnotation = "kustomize.config.k8s.io/field-provenance"
+	// maxProvenanceFields is the most fields that a patch records in
+	// fieldProvenanceAnnotation one by one, rather than by their parent.
+	maxProvenanceFields = 20
+
+	// maxAnnotationsSize is the most bytes, over keys and values, that
+	// the API server accepts in the annotations of an object.
+	maxAnnotationsSize = 256 * (1 << 10)
+)
+
+// TargetOptions holds the options that apply,
+// in place of the top-level ones, to the resources matching Selector.
+type TargetOptions struct {
+	Selector types.Selector  `json:"selector,omitempty" yaml:"selector,omitempty"`
+	Options  map[string]bool `json:"options,omitempty"  yaml:"options,omitempty"`
+}
+
+// MergeIntoEach names a list, by the slash-separated path of a FieldSpec,
+// and the strategic merge patch to merge into each of its elements.
+type MergeIntoEach struct {
+	ListPath string `json:"listPath,omitempty" yaml:"listPath,omitempty"`
+	Patch    string `json:"patch,omitempty"    yaml:"patch,omitempty"`
+}
+
+// RemoveListItems names a list, by the slash-separated path of a
+// FieldSpec, and the field values of the elements to remove from it.
+type RemoveListItems struct {
+	Path  string            `json:"path,omitempty"  yaml:"path,omitempty"`
+	Match map[string]string `json:"match,omitempty" yaml:"match,omitempty"`
+}
+
+// BlastReport lists the resources a patch affected: those it modified,
+// and those referencing, by name, the ones it modified.
+type BlastReport struct {
+	DirectlyModified   []resid.ResId
+	IndirectlyAffected []resid.ResId
+}
+
+// PatchDiff is the unified diff, of the YAML before and after, of a
+// resource the patch modified, which is empty if the patch changed
+// nothing of it.
+type PatchDiff struct {
+	Id   resid.ResId
+	Diff string
+}
+
+// Tracer starts spans timing the phases of the patch: load, parse,
+// select and apply.
+type Tracer interface {
+	Start(name string) Span
+}
+
+// Span is a phase of the patch started by a Tracer.
+type Span interface {
+	End()
+}
+
+// SchemaRegistry holds the schemas of the kinds of resources
+// that patches are checked against.
+type SchemaRegistry interface {
+	// Schema returns the schema of the kind, or nil if it isn't known.
+	Schema(gvk resid.Gvk) *openapi.ResourceSchema
+}
+
+// Severity is how serious a Finding is.
+type Severity string
+
+const (
+	SeverityInfo  Severity = "info"
+	SeverityWarn  Severity = "warn"
+	SeverityError Severity = "error"
+)
+
+// Finding is what a validation, named by Rule after the option or
+// field that enables it, found of a resource after the patch.
+type Finding struct {
+	Severity   Severity
+	ResourceId resid.ResId
+	Rule       string
+	Message    string
+}
+
+// Conflict describes a scalar field that a strategic-merge patch
+// overrode with a different value.
+type Conflict struct {
+	Path        string
+	TargetValue string
+	PatchValue  string
 }
 
 func (p *PatchTransformerPlugin) Config(h *resmap.PluginHelpers, c []byte) error {
 	if err := yaml.Unmarshal(c, p); err != nil {
 		return err
 	}
+	config := string(c)
+	if p.Options["redactPatchSourceInErrors"] {
+		// the config holds the patch, which may hold secrets
+		config = "(config redacted)"
+	}
+	if err := p.checkFields(config); err != nil {
+		return err
+	}
+	if err := p.checkTargets(config); err != nil {
+		return err
+	}
 
 	p.Patch = strings.TrimSpace(p.Patch)
 	switch {
+	case p.MergeIntoEach != nil:
+		return p.configMergeIntoEach()
+	case p.RemoveListItems != nil:
+		return p.configRemoveListItems()
+	case p.SetExpr != "" && (p.Patch != "" || p.Path != ""):
+		return fmt.Errorf("setExpr can't be set along with patch or path\n%s", config)
+	case p.SetExpr != "":
+		return p.configSetExpr()
 	case p.Patch == "" && p.Path == "":
-		return fmt.Errorf("must specify one of patch and path in\n%s", string(c))
+		return fmt.Errorf("must specify one of patch and path in\n%s", config)
 	case p.Patch != "" && p.Path != "":
-		return fmt.Errorf("patch and path can't be set at the same time\n%s", string(c))
-	case p.Patch != "":
+		return fmt.Errorf("patch and path can't be set at the same time\n%s", config)
+	}
+	if err := p.configPatchText(h); err != nil {
+		return err
+	}
+	return p.parsePatch(h)
+}
+
+// checkFields checks the values of the fields that configure the patch,
+// other than its targets.
+func (p *PatchTransformerPlugin) checkFields(config string) error {
+	for path, typ := range p.CoerceTypes {
+		if coerceTags[typ] == "" {
+			return fmt.Errorf(
+				"unsupported type %q to coerce field %q to; expected one of int, string or bool", typ, path)
+		}
+	}
+
+	switch p.PSSLevel {
+	case "", "baseline", "restricted":
+	default:
+		return fmt.Errorf("unsupported pssLevel %q; expected baseline or restricted", p.PSSLevel)
+	}
+	switch p.SessionAffinity {
+	case "", "ClientIP", "None":
+	default:
+		return fmt.Errorf("unsupported sessionAffinity %q; expected ClientIP or None", p.SessionAffinity)
+	}
+	if p.LoadTimeoutMs < 0 {
+		return fmt.Errorf("invalid loadTimeoutMs %d; expected a non-negative number of milliseconds", p.LoadTimeoutMs)
+	}
+	if p.MaxResultDepth < 0 {
+		return fmt.Errorf("invalid maxResultDepth %d; expected a positive number", p.MaxResultDepth)
+	}
+	if p.NamePattern != "" {
+		pattern, err := regexp.Compile("^(?:" + p.NamePattern + ")$")
+		if err != nil {
+			return errors.WrapPrefixf(err, "invalid namePattern %q", p.NamePattern)
+		}
+		p.namePattern = pattern
+	}
+
+	if len(p.ApplyToPaths) == 1 {
+		return fmt.Errorf(
+			"applyToPaths must list at least two paths, the first of which is copied to the others\n%s", config)
+	}
+	if len(p.ApplyToPaths) > 0 && (p.MergeIntoEach != nil || p.RemoveListItems != nil) {
+		return fmt.Errorf("applyToPaths applies only to strategic merge patches\n%s", config)
+	}
+	return nil
+}
+
+// checkTargets checks that the selectors of the targets, and of the
+// PerTargetOptions, can be used together.
+func (p *PatchTransformerPlugin) checkTargets(config string) error {
+	if p.Target != nil && len(p.TargetChain) > 0 {
+		return fmt.Errorf("target and targetChain can't be set at the same time\n%s", config)
+	}
+	if len(p.Targets) > 0 && (p.Target != nil || len(p.TargetChain) > 0) {
+		return fmt.Errorf("targets can't be set along with target or targetChain\n%s", config)
+	}
+	if !p.Options["allowMatchAll"] {
+		for _, target := range append(append([]*types.Selector{p.Target}, p.TargetChain...), p.Targets...) {
+			if target != nil && *target == (types.Selector{}) {
+				return fmt.Errorf(
+					"empty target would match every resource; set option allowMatchAll to allow it\n%s", config)
+			}
+		}
+	}
+
+	for _, entry := range p.PerTargetOptions {
+		for name := range entry.Options {
+			if slices.Contains(patchWideOptions, name) {
+				return fmt.Errorf(
+					"option %s applies to the patch as a whole, and can't be set in perTargetOptions\n%s",
+					name, config)
+			}
+		}
+	}
+	return nil
+}
+
+// configPatchText sets the text of the patch from Patch or, loading it,
+// from Path, as narrowed to the section of Environment and with its
+// concise ops expanded.
+func (p *PatchTransformerPlugin) configPatchText(h *resmap.PluginHelpers) error {
+	if p.Patch != "" {
 		p.patchText = p.Patch
-		p.patchSource = fmt.Sprintf("[patch: %q]", p.patchText)
-	case p.Path != "":
-		loaded, err := h.Loader().Load(p.Path)
+		p.patchSource = p.inlineSource("patch", p.patchText)
+	} else {
+		endLoad := p.startSpan("load")
+		loaded, err := p.load(h.Loader())
+		endLoad()
 		if err != nil {
 			return fmt.Errorf("failed to get the patch file from path(%s): %w", p.Path, err)
 		}
+		// editors on Windows may start UTF-8 files with a byte order mark
+		loaded = bytes.TrimPrefix(loaded, []byte("\ufeff"))
+		if !utf8.Valid(loaded) {
+			return fmt.Errorf(
+				"the patch file from path(%s) isn't valid UTF-8: invalid byte at offset %d",
+				p.Path, invalidUTF8Offset(loaded))
+		}
 		p.patchText = string(loaded)
 		p.patchSource = fmt.Sprintf("[path: %q]", p.Path)
 	}
+	if p.Environment != "" {
+		section, err := environmentSection(p.patchText, p.Environment)
+		if err != nil {
+			return errors.WrapPrefixf(err, "invalid patch %s", p.patchSource)
+		}
+		p.patchText = section
+	}
+	expanded, err := expandConciseOps(p.patchText)
+	if err != nil {
+		return errors.WrapPrefixf(err, "invalid ops in %s", p.patchSource)
+	}
+	if expanded != "" {
+		p.patchText = expanded
+	}
+	return nil
+}
 
+// parsePatch parses the text of the patch as either strategic merge
+// patches or a JSON patch.
+func (p *PatchTransformerPlugin) parsePatch(h *resmap.PluginHelpers) error {
+	endParse := p.startSpan("parse")
 	patchesSM, errSM := h.ResmapFactory().RF().SliceFromBytes([]byte(p.patchText))
 	patchesJson, errJson := jsonPatchFromBytes([]byte(p.patchText))
+	endParse()
 
+	// a patch of nothing but document separators parses as an empty list
+	// of SM patches, and as a null JSON patch, either of which is a no-op
+	if errSM == nil && len(patchesSM) == 0 && len(patchesJson) == 0 {
+		return fmt.Errorf("patch %s holds no patches", p.patchSource)
+	}
 	if (errSM == nil && errJson == nil) ||
 		(patchesSM != nil && patchesJson != nil) {
 		return fmt.Errorf(
@@ -69,85 +483,4558 @@ func (p *PatchTransformerPlugin) Config(h *resmap.PluginHelpers, c []byte) error
 	if errSM == nil {
 		p.smPatches = patchesSM
 		for _, loadedPatch := range p.smPatches {
-			if p.Options["allowNameChange"] {
-				loadedPatch.AllowNameChange()
+			order, err := extractElementOrder(&loadedPatch.RNode)
+			if err != nil {
+				return err
 			}
-			if p.Options["allowKindChange"] {
-				loadedPatch.AllowKindChange()
+			if order != nil {
+				if p.elementOrders == nil {
+					p.elementOrders = make(map[*resource.Resource]*kyaml.RNode)
+				}
+				p.elementOrders[loadedPatch] = order
 			}
 		}
 	} else {
+		if len(p.ApplyToPaths) > 0 {
+			return fmt.Errorf("applyToPaths applies only to strategic merge patches, not to %s", p.patchSource)
+		}
 		p.jsonPatches = patchesJson
 	}
 	return nil
 }
 
-func (p *PatchTransformerPlugin) Transform(m resmap.ResMap) error {
-	if p.smPatches != nil {
-		return p.transformStrategicMerge(m)
+// inlineSource returns the patch source message for a patch given
+// inline in the named field, which holds the hash of the text in place
+// of the text under the option redactPatchSourceInErrors.
+func (p *PatchTransformerPlugin) inlineSource(field, text string) string {
+	if p.Options["redactPatchSourceInErrors"] {
+		return fmt.Sprintf("[%s: sha256:%x]", field, sha256.Sum256([]byte(text)))
 	}
-	return p.transformJson6902(m)
+	return fmt.Sprintf("[%s: %q]", field, text)
 }
 
-// transformStrategicMerge applies each loaded strategic merge patch
-// to the resource in the ResMap that matches the identifier of the patch.
-// If only one patch is specified, the Target can be used instead.
-func (p *PatchTransformerPlugin) transformStrategicMerge(m resmap.ResMap) error {
-	if p.Target != nil {
-		if len(p.smPatches) > 1 {
-			// detail: https://github.com/kubernetes-sigs/kustomize/issues/5049#issuecomment-1440604403
-			return fmt.Errorf("Multiple Strategic-Merge Patches in one `patches` entry is not allowed to set `patches.target` field: %s", p.patchSource)
-		}
+// configRemoveListItems checks the fields of RemoveListItems.
+func (p *PatchTransformerPlugin) configRemoveListItems() error {
+	switch {
+	case p.Patch != "" || p.Path != "":
+		return fmt.Errorf("removeListItems can't be set along with patch or path")
+	case !p.targeted():
+		return fmt.Errorf("must specify a target for removeListItems")
+	case p.RemoveListItems.Path == "":
+		return fmt.Errorf("must specify the path of removeListItems")
+	case len(p.RemoveListItems.Match) == 0:
+		return fmt.Errorf("must specify the field values to match in removeListItems")
+	}
+	p.patchSource = fmt.Sprintf("[removeListItems: %q]", p.RemoveListItems.Path)
+	return nil
+}
 
-		// single patch
-		patch := p.smPatches[0]
-		selected, err := m.Select(*p.Target)
-		if err != nil {
-			return fmt.Errorf("unable to find patch target %q in `resources`: %w", p.Target, err)
-		}
-		return errors.Wrap(m.ApplySmPatch(resource.MakeIdSet(selected), patch))
+// configSetExpr parses SetExpr into a strategic merge patch which,
+// as it names no resource, applies to the targets whatever their kind
+// and name.
+func (p *PatchTransformerPlugin) configSetExpr() error {
+	if !p.targeted() {
+		return fmt.Errorf("must specify a target for setExpr")
+	}
+	p.patchSource = p.inlineSource("setExpr", p.SetExpr)
+	patch, err := setExprPatch(p.SetExpr)
+	if err != nil {
+		return errors.WrapPrefixf(err, "unable to parse %s", p.patchSource)
 	}
+	p.patchText = patch.MustString()
+	p.smPatches = []*resource.Resource{{RNode: *patch}}
+	return nil
+}
 
-	for _, patch := range p.smPatches {
-		target, err := m.GetById(patch.OrgId())
+// setExprPatch returns the strategic merge patch that sets the fields
+// given by the query string expression of SetExpr.
+func setExprPatch(expr string) (*kyaml.RNode, error) {
+	patch := kyaml.NewMapRNode(nil)
+	for _, term := range strings.Split(expr, "&") {
+		field, value, found := strings.Cut(term, "=")
+		if !found || field == "" {
+			return nil, fmt.Errorf("expected field=value, not %q", term)
+		}
+		field, err := url.QueryUnescape(field)
 		if err != nil {
-			return fmt.Errorf("no resource matches strategic merge patch %q: %w", patch.OrgId(), err)
+			return nil, errors.Wrap(err)
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		path := utils.SmarterPathSplitter(field, ".")
+		err = patch.PipeE(
+			kyaml.LookupCreate(kyaml.MappingNode, path[:len(path)-1]...),
+			kyaml.SetField(path[len(path)-1], kyaml.NewScalarRNode(value)))
+		if err != nil {
+			return nil, errors.WrapPrefixf(err, "setting %s", field)
 		}
-		if err := target.ApplySmPatch(patch); err != nil {
-			return errors.Wrap(err)
+	}
+	return patch, nil
+}
+
+// load loads the patch from Path, giving up after LoadTimeoutMs.
+// As the loader can't be cancelled, a load given up on is abandoned
+// rather than stopped: it runs on until the loader returns, and what
+// it loads is discarded.
+func (p *PatchTransformerPlugin) load(ldr ifc.Loader) ([]byte, error) {
+	timeout := p.LoadTimeoutMs
+	if timeout == 0 {
+		timeout = defaultLoadTimeoutMs
+	}
+	type result struct {
+		content []byte
+		err     error
+	}
+	// buffered, so that the load may finish after it's given up on
+	done := make(chan result, 1)
+	// the goroutine may outlive this call, and so mustn't read p,
+	// which a later call of Config overwrites
+	path := p.Path
+	go func() {
+		content, err := ldr.Load(path)
+		done <- result{content, err}
+	}()
+	select {
+	case r := <-done:
+		return r.content, r.err
+	case <-time.After(time.Duration(timeout) * time.Millisecond):
+		return nil, fmt.Errorf("timed out after %dms", timeout)
+	}
+}
+
+// invalidUTF8Offset returns the offset of the first byte of the data
+// that isn't part of a valid UTF-8 encoding, or -1 if there's none.
+func invalidUTF8Offset(data []byte) int {
+	for offset := 0; offset < len(data); {
+		r, size := utf8.DecodeRune(data[offset:])
+		if r == utf8.RuneError && size == 1 {
+			return offset
 		}
+		offset += size
 	}
+	return -1
+}
+
+// configMergeIntoEach parses the patch of MergeIntoEach.
+func (p *PatchTransformerPlugin) configMergeIntoEach() error {
+	switch {
+	case p.Patch != "" || p.Path != "":
+		return fmt.Errorf("mergeIntoEach can't be set along with patch or path")
+	case !p.targeted():
+		return fmt.Errorf("must specify a target for mergeIntoEach")
+	case p.MergeIntoEach.ListPath == "":
+		return fmt.Errorf("must specify the listPath of mergeIntoEach")
+	}
+	p.patchSource = fmt.Sprintf("[mergeIntoEach: %q]", p.MergeIntoEach.ListPath)
+	patch, err := kyaml.Parse(p.MergeIntoEach.Patch)
+	if err != nil {
+		return errors.WrapPrefixf(err, "unable to parse the patch of %s", p.patchSource)
+	}
+	if patch.YNode().Kind != kyaml.MappingNode {
+		return fmt.Errorf("the patch of %s must be a map", p.patchSource)
+	}
+	p.elementPatch = patch
 	return nil
 }
 
-// transformJson6902 applies json6902 Patch to all the resources in the ResMap that match Target.
-func (p *PatchTransformerPlugin) transformJson6902(m resmap.ResMap) error {
-	if p.Target == nil {
-		return fmt.Errorf("must specify a target for JSON patch %s", p.patchSource)
+// TransformerPriority returns Priority, by which the build orders
+// this transformer relative to the others.
+func (p *PatchTransformerPlugin) TransformerPriority() int {
+	return p.Priority
+}
+
+// SetTracer sets the tracer with which Config and Transform
+// record spans of their phases.
+func (p *PatchTransformerPlugin) SetTracer(tracer Tracer) {
+	p.tracer = tracer
+}
+
+// SetSchemaRegistry sets the registry that Transform checks, before
+// patching, that it knows the kind of each target, and the schema of
+// that kind has each field a strategic merge patch sets.
+func (p *PatchTransformerPlugin) SetSchemaRegistry(registry SchemaRegistry) {
+	p.schemaRegistry = registry
+}
+
+// startSpan starts a span of the named phase, returning the function
+// that ends it, which does nothing if no tracer is set.
+func (p *PatchTransformerPlugin) startSpan(name string) func() {
+	if p.tracer == nil {
+		return func() {}
 	}
-	resources, err := m.Select(*p.Target)
+	return p.tracer.Start(name).End
+}
+
+// SetCapabilities injects the APIs available on the target cluster,
+// in group/version/kind form, against which RequireCapabilities is checked.
+func (p *PatchTransformerPlugin) SetCapabilities(capabilities []string) {
+	p.capabilities = make(map[string]bool, len(capabilities))
+	for _, c := range capabilities {
+		p.capabilities[c] = true
+	}
+}
+
+// Notes returns the informational messages recorded by Transform.
+func (p *PatchTransformerPlugin) Notes() []string {
+	return p.notes
+}
+
+// DecodedJSONPatch returns a copy of the operations of the JSON 6902
+// patch, and whether the patch is one.
+func (p *PatchTransformerPlugin) DecodedJSONPatch() (jsonpatch.Patch, bool) {
+	if p.jsonPatches == nil {
+		return nil, false
+	}
+	ops := make(jsonpatch.Patch, len(p.jsonPatches))
+	for i, op := range p.jsonPatches {
+		ops[i] = make(jsonpatch.Operation, len(op))
+		for key, value := range op {
+			if value != nil {
+				raw := slices.Clone(*value)
+				value = &raw
+			}
+			ops[i][key] = value
+		}
+	}
+	return ops, true
+}
+
+// EffectivePatch returns the text of the patch as it's applied, after
+// the selection of its Environment section and the expansion of concise
+// ops, and a copy of Options with perDocument, the only option on by
+// default, filled in if unset. The options it leaves out are off, but
+// for the resources whose PerTargetOptions override them, which the
+// copy doesn't reflect.
+func (p *PatchTransformerPlugin) EffectivePatch() (string, map[string]bool) {
+	options := make(map[string]bool, len(p.Options)+1)
+	for name, value := range p.Options {
+		options[name] = value
+	}
+	if _, ok := options["perDocument"]; !ok {
+		options["perDocument"] = true
+	}
+	return p.patchText, options
+}
+
+// Findings returns what the enabled validations found of the resources,
+// after the patch: the violations they noted, as warnings, and the one
+// that failed Transform, if any, as an error.
+func (p *PatchTransformerPlugin) Findings() []Finding {
+	return p.findings
+}
+
+// find records a finding of the rule for the resource.
+func (p *PatchTransformerPlugin) find(severity Severity, res *resource.Resource, rule, message string) {
+	p.findings = append(p.findings, Finding{
+		Severity:   severity,
+		ResourceId: res.CurId(),
+		Rule:       rule,
+		Message:    message,
+	})
+}
+
+// failed records the error, if there's one, as an error finding
+// of the rule for the resource, and returns it.
+func (p *PatchTransformerPlugin) failed(res *resource.Resource, rule string, err error) error {
 	if err != nil {
-		return err
+		p.find(SeverityError, res, rule, err.Error())
 	}
-	for _, res := range resources {
-		res.StorePreviousId()
-		internalAnnotations := kioutil.GetInternalAnnotations(&res.RNode)
-		err = res.ApplyFilter(patchjson6902.Filter{
-			Patch: p.patchText,
-		})
+	return err
+}
+
+// SkippedResources returns, per id of each resource that the patch
+// targeted but left as it was, the reason it did, e.g. "kind not
+// allowed" under AllowedKinds.
+func (p *PatchTransformerPlugin) SkippedResources() map[resid.ResId]string {
+	return p.skipped
+}
+
+// FieldConflicts returns, per patched resource id, the scalar fields
+// whose value the patch overrode, as recorded when the option
+// reportFieldConflicts is set.
+func (p *PatchTransformerPlugin) FieldConflicts() map[string][]Conflict {
+	return p.fieldConflicts
+}
+
+func (p *PatchTransformerPlugin) Transform(m resmap.ResMap) error {
+	return p.transform([]resmap.ResMap{m})
+}
+
+// ApplyToAll applies each of the configured plugins across all of the
+// ResMaps, for tooling that builds components separately. Targets are
+// selected within each ResMap independently, except that the target
+// of an untargeted strategic merge patch need only be found in one.
+func ApplyToAll(plugins []*PatchTransformerPlugin, maps []resmap.ResMap) error {
+	for _, p := range plugins {
+		if err := p.transform(maps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PatchTransformerPlugin) transform(maps []resmap.ResMap) error {
+	p.reset()
+	if p.Options["assertDeterministic"] {
+		if err := p.assertDeterministic(maps); err != nil {
+			return err
+		}
+	}
+	p.maps = maps
+	if len(p.RequireCapabilities) > 0 && p.capabilities == nil {
+		// with nothing to check them against, as under kustomize build,
+		// skipping the patch would drop it unnoticed
+		return fmt.Errorf(
+			"patch %s requires capabilities %s, but the cluster's weren't set with SetCapabilities",
+			p.patchSource, strings.Join(p.RequireCapabilities, ", "))
+	}
+	if missing := p.missingCapabilities(); len(missing) > 0 {
+		p.notes = append(p.notes, fmt.Sprintf(
+			"skipped patch %s: cluster lacks required capabilities %s",
+			p.patchSource, strings.Join(missing, ", ")))
+		return nil
+	}
+	if len(p.TargetChain) > 0 {
+		target, err := firstMatchingTarget(p.TargetChain, maps)
 		if err != nil {
 			return err
 		}
+		p.chainTarget = target
+	}
+	if err := p.selectTargetOptions(maps); err != nil {
+		return err
+	}
+	if err := p.apply(maps); err != nil {
+		return err
+	}
+	for _, res := range p.modified {
+		if err := p.postProcess(res); err != nil {
+			return err
+		}
+	}
+	if err := p.annotateSyncWave(); err != nil {
+		return err
+	}
+	if err := p.fixHPARefs(maps); err != nil {
+		return err
+	}
+	if err := p.coerceTypes(); err != nil {
+		return err
+	}
+	for _, res := range p.modified {
+		if p.option(res, "annotateFieldProvenance") {
+			if err := p.annotateFieldProvenance(res); err != nil {
+				return err
+			}
+		}
+		// last, for the fields the steps above add to be sorted too
+		if p.option(res, "sortMapKeys") {
+			sortMapKeys(res.YNode())
+		}
+	}
+	return p.validate(maps)
+}
+
+// postProcess adjusts the resource, once patched, as its options ask.
+func (p *PatchTransformerPlugin) postProcess(res *resource.Resource) error {
+	if p.option(res, "preserveQuoteStyle") {
+		preserveQuoteStyle(p.originals[res], &res.RNode)
+	}
+	if p.jsonPatches != nil && p.option(res, "preserveCommentsJson6902") {
+		// the JSON patch goes through JSON, which drops comments
+		if err := comments.CopyComments(p.originals[res], &res.RNode); err != nil {
+			return errors.WrapPrefixf(err, "restoring the comments of %s %s", res.GetKind(), res.GetName())
+		}
+	}
+	if p.option(res, "mergeConfigMapData") {
+		if err := mergeConfigMapData(p.originals[res], res, p.deletedDataKeys(res)); err != nil {
+			return err
+		}
+	}
+	if p.option(res, "stripManagedFields") {
+		// managedFields are kept by the server, and don't belong in manifests
+		if err := res.PipeE(kyaml.Lookup(kyaml.MetadataField), kyaml.Clear("managedFields")); err != nil {
+			return errors.WrapPrefixf(err, "stripping the managedFields of %s %s", res.GetKind(), res.GetName())
+		}
+	}
+	if p.option(res, "preserveEmptyCollections") {
+		for _, patch := range p.smPatches {
+			if p.targeted() || patch.OrgId().Equals(res.OrgId()) {
+				restoreEmptyCollections(p.originals[res].YNode(), res.YNode(), patch.YNode())
+			}
+		}
+	}
+	if p.option(res, "dedupeEnvByName") {
+		if spec := podSpec(res); spec != nil {
+			for _, container := range podContainers(spec) {
+				dedupeEnv(container)
+			}
+		}
+	}
+	if p.option(res, "stripLiveFields") {
+		// resourceVersion, uid and creationTimestamp come from a live object, and are rejected or ignored on apply
+		for _, field := range []string{"resourceVersion", "uid", "creationTimestamp"} {
+			if err := res.PipeE(kyaml.Lookup(kyaml.MetadataField), kyaml.Clear(field)); err != nil {
+				return errors.WrapPrefixf(err, "stripping the %s of %s %s", field, res.GetKind(), res.GetName())
+			}
+		}
+	}
+	return nil
+}
+
+// incompatibility returns why the patch doesn't fit the structure of
+// the resource, or an empty string if it does. A JSON patch doesn't fit
+// if it fails to apply, e.g. for lack of the path it adds to; a
+// strategic merge patch, if it sets a field that isn't in the schema of
+// the resource's type, where that schema is known.
+func (p *PatchTransformerPlugin) incompatibility(res *resource.Resource) string {
+	if p.jsonPatches != nil {
+		_, patchText, err := p.resolvedPatch(&res.RNode)
+		if err == nil {
+			_, err = patchjson6902.Filter{Patch: patchText}.Filter([]*kyaml.RNode{res.RNode.Copy()})
+		}
+		if err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+	if len(p.smPatches) != 1 {
+		return ""
+	}
+	schema := openapi.SchemaForResourceType(kyaml.TypeMeta{
+		APIVersion: res.GetApiVersion(),
+		Kind:       res.GetKind(),
+	})
+	if schema == nil {
+		return ""
+	}
+	if path := unknownField(nil, &p.smPatches[0].RNode, schema); path != "" {
+		return fmt.Sprintf("%s has no field %s", res.GetKind(), path)
+	}
+	return ""
+}
+
+// unknownField returns the dot-separated path of the first field set
+// by the patch that the schema doesn't know, or an empty string if it
+// knows them all. The identifying fields and directives are left out,
+// as are the fields of objects the schema doesn't describe.
+func unknownField(path []string, patch *kyaml.RNode, schema *openapi.ResourceSchema) string {
+	if schema == nil || schema.Schema == nil ||
+		(len(schema.Schema.Properties) == 0 && schema.Schema.AdditionalProperties == nil) {
+		return ""
+	}
+	switch patch.YNode().Kind {
+	case kyaml.MappingNode:
+		var unknown string
+		_ = patch.VisitFields(func(node *kyaml.MapNode) error {
+			key := node.Key.YNode().Value
+			if unknown != "" || strings.HasPrefix(key, "$") ||
+				(len(path) == 0 && (key == kyaml.APIVersionField || key == kyaml.KindField || key == kyaml.MetadataField)) {
+				return nil
+			}
+			fieldPath := append(path[:len(path):len(path)], key)
+			field := schema.Field(key)
+			if field == nil {
+				unknown = strings.Join(fieldPath, ".")
+				return nil
+			}
+			unknown = unknownField(fieldPath, node.Value, field)
+			return nil
+		})
+		return unknown
+	case kyaml.SequenceNode:
+		elements := schema.Elements()
+		for _, element := range patch.YNode().Content {
+			if unknown := unknownField(path, kyaml.NewRNode(element), elements); unknown != "" {
+				return unknown
+			}
+		}
+	}
+	return ""
+}
+
+// firstMatchingTarget returns the first of the selectors that matches
+// a resource in any of the ResMaps, or the last if none match.
+func firstMatchingTarget(chain []*types.Selector, maps []resmap.ResMap) (*types.Selector, error) {
+	for _, target := range chain {
+		for _, m := range maps {
+			selected, err := m.Select(*target)
+			if err != nil {
+				return nil, err
+			}
+			if len(selected) > 0 {
+				return target, nil
+			}
+		}
+	}
+	return chain[len(chain)-1], nil
+}
+
+// apply applies the patch to the targets in the ResMaps.
+func (p *PatchTransformerPlugin) apply(maps []resmap.ResMap) error {
+	defer p.startSpan("apply")()
+	switch {
+	case p.RemoveListItems != nil:
+		for _, m := range maps {
+			if err := p.transformRemoveListItems(m); err != nil {
+				return err
+			}
+		}
+	case p.elementPatch != nil:
+		for _, m := range maps {
+			if err := p.transformMergeIntoEach(m); err != nil {
+				return err
+			}
+		}
+	case p.smPatches != nil:
+		return p.transformStrategicMerge(maps)
+	default:
+		for _, m := range maps {
+			if err := p.transformJson6902(m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-		annotations := res.GetAnnotations()
-		for key, value := range internalAnnotations {
-			annotations[key] = value
+// selectTargetOptions records, for each resource matched by an entry
+// of PerTargetOptions, the options that the entry overrides.
+func (p *PatchTransformerPlugin) selectTargetOptions(maps []resmap.ResMap) error {
+	for _, entry := range p.PerTargetOptions {
+		for _, m := range maps {
+			selected, err := m.Select(entry.Selector)
+			if err != nil {
+				return err
+			}
+			for _, res := range selected {
+				if p.targetOptions == nil {
+					p.targetOptions = make(map[*resource.Resource]map[string]bool)
+				}
+				if p.targetOptions[res] == nil {
+					p.targetOptions[res] = make(map[string]bool)
+				}
+				for name, value := range entry.Options {
+					p.targetOptions[res][name] = value
+				}
+			}
 		}
-		err = res.SetAnnotations(annotations)
 	}
 	return nil
 }
 
+// patchWideOptions are the options that apply to the patch as a whole,
+// or to each ResMap, rather than to one resource at a time.
+var patchWideOptions = []string{ //nolint:gochecknoglobals
+	"allowMatchAll",
+	"assertDeterministic",
+	"checkAgainstResourceQuota",
+	"perDocument",
+	"redactPatchSourceInErrors",
+	"validateConfigRefs",
+}
+
+// option reports whether the named option is set for the resource,
+// as overridden by PerTargetOptions or else as given in Options.
+func (p *PatchTransformerPlugin) option(res *resource.Resource, name string) bool {
+	if value, ok := p.targetOptions[res][name]; ok {
+		return value
+	}
+	return p.Options[name]
+}
+
+// patchFor returns the strategic merge patch to apply to the resource:
+// the patch itself, or a copy of it adapted to the resource's options,
+// that allows name or kind changes, or that spells out the lists the
+// patch appends to under keylessMergeAppend.
+func (p *PatchTransformerPlugin) patchFor(res, patch *resource.Resource) *resource.Resource {
+	allowNameChange := p.option(res, "allowNameChange")
+	allowKindChange := p.option(res, "allowKindChange")
+	keylessMergeAppend := p.option(res, "keylessMergeAppend")
+	replaceProbes := p.option(res, "replaceProbeBlocks")
+	if !allowNameChange && !allowKindChange && !keylessMergeAppend && !replaceProbes && len(p.ApplyToPaths) < 2 {
+		return patch
+	}
+	patchCopy := patch.DeepCopy()
+	if allowNameChange {
+		patchCopy.AllowNameChange()
+	}
+	if allowKindChange {
+		patchCopy.AllowKindChange()
+	}
+	if keylessMergeAppend {
+		appendKeylessLists(&res.RNode, &patchCopy.RNode, p.option(res, "keylessMergeDedupe"))
+	}
+	if replaceProbes {
+		replaceProbeBlocks(patchCopy.YNode())
+	}
+	if len(p.ApplyToPaths) > 1 {
+		p.copyToPaths(&res.RNode, &patchCopy.RNode)
+	}
+	return patchCopy
+}
+
+// copyToPaths sets, in the patch, each of ApplyToPaths after the first
+// that the resource has and the patch doesn't to a copy of what the
+// patch sets under the first.
+func (p *PatchTransformerPlugin) copyToPaths(res, patch *kyaml.RNode) {
+	subtree, _ := patch.Pipe(kyaml.Lookup(utils.PathSplitter(p.ApplyToPaths[0], "/")...))
+	if subtree == nil {
+		return
+	}
+	for _, path := range p.ApplyToPaths[1:] {
+		fields := utils.PathSplitter(path, "/")
+		if existing, _ := res.Pipe(kyaml.Lookup(fields...)); existing == nil {
+			continue
+		}
+		if existing, _ := patch.Pipe(kyaml.Lookup(fields...)); existing != nil {
+			continue
+		}
+		_ = patch.PipeE(
+			kyaml.LookupCreate(kyaml.MappingNode, fields[:len(fields)-1]...),
+			kyaml.SetField(fields[len(fields)-1], subtree.Copy()))
+	}
+}
+
+// probeBlocks are the fields of a container holding a probe or a
+// lifecycle hook, whose subfields only make sense together.
+var probeBlocks = []string{ //nolint:gochecknoglobals
+	"livenessProbe", "readinessProbe", "startupProbe", "postStart", "preStop",
+}
+
+// replaceProbeBlocks marks each probe and lifecycle hook of the patch
+// with a $patch: replace directive, so that it replaces that of the
+// target as a whole, rather than merging into it and leaving stale
+// subfields, e.g. the httpGet of a probe that the patch makes exec.
+func replaceProbeBlocks(node *kyaml.Node) {
+	if node.Kind == kyaml.MappingNode {
+		for i := 1; i < len(node.Content); i += 2 {
+			value := node.Content[i]
+			if value.Kind == kyaml.MappingNode && slices.Contains(probeBlocks, node.Content[i-1].Value) {
+				_ = kyaml.NewRNode(value).PipeE(kyaml.SetField("$patch", kyaml.NewScalarRNode("replace")))
+			}
+		}
+	}
+	for _, n := range node.Content {
+		replaceProbeBlocks(n)
+	}
+}
+
+// appendKeylessLists walks the patch alongside the target, and for each
+// list of the patch holding a $patch: merge directive prepends to the
+// list's elements those of the target's list, which the patch then
+// replaces, so that the merge of a list without a merge key appends to
+// it. If dedupe is set, elements already in the target aren't repeated.
+// List elements are paired up by name, since that's the usual merge key.
+func appendKeylessLists(target, patch *kyaml.RNode, dedupe bool) {
+	if target.IsNilOrEmpty() || patch.IsNilOrEmpty() {
+		return
+	}
+	switch patch.YNode().Kind {
+	case kyaml.MappingNode:
+		_ = patch.VisitFields(func(node *kyaml.MapNode) error {
+			if field := target.Field(node.Key.YNode().Value); field != nil {
+				appendKeylessLists(field.Value, node.Value, dedupe)
+			}
+			return nil
+		})
+	case kyaml.SequenceNode:
+		var elements []*kyaml.Node
+		merge := false
+		for _, element := range patch.YNode().Content {
+			if isMergeDirective(element) {
+				merge = true
+				continue
+			}
+			elements = append(elements, element)
+		}
+		if !merge {
+			for _, element := range patch.YNode().Content {
+				name := kyaml.NewRNode(element).Field(kyaml.NameField)
+				if name == nil {
+					continue
+				}
+				match, _ := target.Pipe(kyaml.MatchElement(kyaml.NameField, name.Value.YNode().Value))
+				appendKeylessLists(match, kyaml.NewRNode(element), dedupe)
+			}
+			return
+		}
+		if target.YNode().Kind != kyaml.SequenceNode {
+			patch.YNode().Content = elements
+			return
+		}
+		combined := slices.Clone(target.YNode().Content)
+		for _, element := range elements {
+			if dedupe && slices.ContainsFunc(combined, func(n *kyaml.Node) bool {
+				return kyaml.NewRNode(n).MustString() == kyaml.NewRNode(element).MustString()
+			}) {
+				continue
+			}
+			combined = append(combined, element)
+		}
+		patch.YNode().Content = combined
+	}
+}
+
+// restoreEmptyCollections adds back to the patched node each explicitly
+// empty list or map of the original that the strategic merge patch
+// doesn't mention, but which is missing after the merge. Nothing is
+// restored under an object of the patch with a $patch directive, e.g.
+// one replacing the object. List elements are matched by name, or
+// else by position.
+func restoreEmptyCollections(original, patched, patch *kyaml.Node) {
+	if original == nil || patched == nil || original.Kind != patched.Kind {
+		return
+	}
+	if patch != nil && (patch.Kind != original.Kind ||
+		(patch.Kind == kyaml.MappingNode && kyaml.NewRNode(patch).Field("$patch") != nil)) {
+		return
+	}
+	switch original.Kind {
+	case kyaml.MappingNode:
+		for i := 0; i+1 < len(original.Content); i += 2 {
+			key, value := original.Content[i].Value, original.Content[i+1]
+			var patchValue *kyaml.Node
+			if patch != nil {
+				if field := kyaml.NewRNode(patch).Field(key); field != nil {
+					patchValue = field.Value.YNode()
+				}
+			}
+			field := kyaml.NewRNode(patched).Field(key)
+			if field != nil {
+				restoreEmptyCollections(value, field.Value.YNode(), patchValue)
+				continue
+			}
+			if patchValue == nil && value.Kind != kyaml.ScalarNode && len(value.Content) == 0 {
+				patched.Content = append(patched.Content, original.Content[i], value)
+			}
+		}
+	case kyaml.SequenceNode:
+		for i, element := range original.Content {
+			restoreEmptyCollections(element,
+				matchingElement(patched, element, i), matchingElement(patch, element, -1))
+		}
+	}
+}
+
+// matchingElement returns the element of the list with the name of the
+// given element or, if it has none, the element at the index,
+// or nil if there's none.
+func matchingElement(list, element *kyaml.Node, index int) *kyaml.Node {
+	if list == nil || list.Kind != kyaml.SequenceNode {
+		return nil
+	}
+	name := kyaml.NewRNode(element).Field(kyaml.NameField)
+	if element.Kind != kyaml.MappingNode || name == nil {
+		if index >= 0 && index < len(list.Content) {
+			return list.Content[index]
+		}
+		return nil
+	}
+	for _, candidate := range list.Content {
+		if other := kyaml.NewRNode(candidate).Field(kyaml.NameField); candidate.Kind == kyaml.MappingNode &&
+			other != nil && other.Value.YNode().Value == name.Value.YNode().Value {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// dedupeEnv removes from the env of the container each variable that
+// a later one has the name of, so that the last one set wins.
+func dedupeEnv(container *kyaml.RNode) {
+	env, _ := container.Pipe(kyaml.Lookup("env"))
+	if env == nil || env.YNode().Kind != kyaml.SequenceNode {
+		return
+	}
+	elements := env.YNode().Content
+	seen := make(map[string]bool)
+	kept := make([]*kyaml.Node, 0, len(elements))
+	for i := len(elements) - 1; i >= 0; i-- {
+		name, err := kyaml.NewRNode(elements[i]).GetString(kyaml.NameField)
+		if err == nil && seen[name] {
+			continue
+		}
+		seen[name] = true
+		kept = append(kept, elements[i])
+	}
+	slices.Reverse(kept)
+	env.YNode().Content = kept
+}
+
+// isMergeDirective reports whether the list element
+// is the directive $patch: merge.
+func isMergeDirective(element *kyaml.Node) bool {
+	return element.Kind == kyaml.MappingNode && len(element.Content) == 2 &&
+		element.Content[0].Value == "$patch" && element.Content[1].Value == "merge"
+}
+
+// fixHPARefs points, for each modified resource that the patch renamed
+// and that has the option fixHPARefs, the scaleTargetRef of the
+// HorizontalPodAutoscalers in its namespace that referred to it by its
+// old name at its new name.
+func (p *PatchTransformerPlugin) fixHPARefs(maps []resmap.ResMap) error {
+	for _, res := range p.modified {
+		original := p.originals[res]
+		if !p.option(res, "fixHPARefs") || original == nil || res.IsNilOrEmpty() ||
+			original.GetName() == res.GetName() {
+			continue
+		}
+		for _, m := range maps {
+			for _, hpa := range m.Resources() {
+				if hpa.GetKind() != "HorizontalPodAutoscaler" || hpa.GetNamespace() != res.GetNamespace() {
+					continue
+				}
+				ref, _ := hpa.Pipe(kyaml.Lookup("spec", "scaleTargetRef"))
+				if ref == nil {
+					continue
+				}
+				kind, _ := ref.GetString(kyaml.KindField)
+				name, _ := ref.GetString(kyaml.NameField)
+				if kind != original.GetKind() || name != original.GetName() {
+					continue
+				}
+				if err := ref.PipeE(kyaml.SetField(kyaml.NameField, kyaml.NewScalarRNode(res.GetName()))); err != nil {
+					return errors.WrapPrefixf(err, "updating the scaleTargetRef of HorizontalPodAutoscaler %s",
+						hpa.GetName())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// annotateSyncWave annotates each modified resource with SyncWave,
+// if it's set.
+func (p *PatchTransformerPlugin) annotateSyncWave() error {
+	if p.SyncWave == nil {
+		return nil
+	}
+	key := p.SyncWaveAnnotation
+	if key == "" {
+		key = defaultSyncWaveAnnotation
+	}
+	for _, res := range p.modified {
+		if err := res.PipeE(kyaml.SetAnnotation(key, strconv.Itoa(*p.SyncWave))); err != nil {
+			return errors.WrapPrefixf(err, "annotating %s %s with its sync wave", res.GetKind(), res.GetName())
+		}
+	}
+	return nil
+}
+
+// snapshot keeps a copy of the resource as it was
+// before the patch was first applied to it. Under the option
+// tolerateTemplateTokens, the resource's template tokens are then
+// made strings, ready for patching.
+func (p *PatchTransformerPlugin) snapshot(res *resource.Resource) {
+	if _, ok := p.originals[res]; ok {
+		return
+	}
+	if p.originals == nil {
+		p.originals = make(map[*resource.Resource]*kyaml.RNode)
+	}
+	p.originals[res] = res.RNode.Copy()
+	if p.option(res, "tolerateTemplateTokens") {
+		quoteTemplateTokens(res.YNode())
+	}
+}
+
+// quoteTemplateTokens replaces each unquoted template token in the
+// node, e.g. {{ .Values.replicas }}, which YAML reads as a map keyed by
+// a map, with the string of the token.
+func quoteTemplateTokens(node *kyaml.Node) {
+	for i, n := range node.Content {
+		if token, ok := templateToken(n); ok {
+			node.Content[i] = &kyaml.Node{Kind: kyaml.ScalarNode, Tag: kyaml.NodeTagString, Value: token}
+			continue
+		}
+		quoteTemplateTokens(n)
+	}
+}
+
+// templateToken returns the template token that YAML read as the
+// node, if any: a flow map of a single, valueless key that is itself a
+// flow map of a single, valueless key.
+func templateToken(node *kyaml.Node) (string, bool) {
+	single := func(n *kyaml.Node) bool {
+		return n.Kind == kyaml.MappingNode && n.Style&kyaml.FlowStyle != 0 &&
+			len(n.Content) == 2 && n.Content[1].Kind == kyaml.ScalarNode &&
+			n.Content[1].ShortTag() == kyaml.NodeTagNull
+	}
+	if !single(node) || !single(node.Content[0]) || node.Content[0].Content[0].Kind != kyaml.ScalarNode {
+		return "", false
+	}
+	return "{{ " + node.Content[0].Content[0].Value + " }}", true
+}
+
+// visitScalars calls fn with the path to, and the node of, each scalar
+// in node. Paths are dot-separated, bracketing keys that hold dots, e.g.
+// metadata.labels.[app.kubernetes.io/name], and name list elements by
+// their name field where they have one, or else by their index.
+func visitScalars(path string, node *kyaml.Node, fn func(path string, scalar *kyaml.Node)) {
+	if node == nil {
+		return
+	}
+	join := func(field string) string {
+		field = bracketKey(field)
+		if path == "" {
+			return field
+		}
+		return path + "." + field
+	}
+	switch node.Kind {
+	case kyaml.ScalarNode:
+		fn(path, node)
+	case kyaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			visitScalars(join(node.Content[i].Value), node.Content[i+1], fn)
+		}
+	case kyaml.SequenceNode:
+		for i, element := range node.Content {
+			key := fmt.Sprintf("%s[%d]", path, i)
+			if name := kyaml.NewRNode(element).Field(kyaml.NameField); element.Kind == kyaml.MappingNode &&
+				name != nil && name.Value.YNode().Kind == kyaml.ScalarNode {
+				key = fmt.Sprintf("%s[name=%s]", path, name.Value.YNode().Value)
+			}
+			visitScalars(key, element, fn)
+		}
+	case kyaml.DocumentNode:
+		for _, n := range node.Content {
+			visitScalars(path, n, fn)
+		}
+	}
+}
+
+// preserveQuoteStyle gives each string scalar of the patched resource
+// the quoting style of the scalar at the same path in the original,
+// where the value would still read as a string in that style.
+func preserveQuoteStyle(original, patched *kyaml.RNode) {
+	if original == nil {
+		return
+	}
+	styles := make(map[string]kyaml.Style)
+	visitScalars("", original.YNode(), func(path string, scalar *kyaml.Node) {
+		styles[path] = scalar.Style
+	})
+	visitScalars("", patched.YNode(), func(path string, scalar *kyaml.Node) {
+		style, ok := styles[path]
+		if !ok || style == scalar.Style || scalar.ShortTag() != kyaml.NodeTagString {
+			return
+		}
+		if style == 0 || style == kyaml.TaggedStyle {
+			// only drop the quotes if the plain value still reads as a string
+			plain := kyaml.Node{Kind: kyaml.ScalarNode, Value: scalar.Value}
+			if plain.ShortTag() != kyaml.NodeTagString {
+				return
+			}
+		}
+		if style == kyaml.DoubleQuotedStyle || style == kyaml.SingleQuotedStyle || style == 0 {
+			scalar.Style = style
+		}
+	})
+}
+
+// coerceTags maps the types that CoerceTypes accepts to their YAML tags.
+var coerceTags = map[string]string{ //nolint:gochecknoglobals
+	"int":    kyaml.NodeTagInt,
+	"string": kyaml.NodeTagString,
+	"bool":   kyaml.NodeTagBool,
+}
+
+// annotateFieldProvenance records, under fieldProvenanceAnnotation, the
+// patch as the source of each field it changed in the resource, adding
+// to what earlier patches recorded. A patch that changed more than
+// maxProvenanceFields fields is recorded once, for their common parent
+// path followed by .*, to keep the annotation small. The patch is
+// identified by provenanceSource.
+func (p *PatchTransformerPlugin) annotateFieldProvenance(res *resource.Resource) error {
+	var paths []string
+	for _, change := range p.patchChanges(res) {
+		paths = append(paths, change.path)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	if len(paths) > maxProvenanceFields {
+		common := pathSegments(paths[0])
+		for _, path := range paths[1:] {
+			segments := pathSegments(path)
+			n := 0
+			for n < len(common) && n < len(segments) && common[n] == segments[n] {
+				n++
+			}
+			common = common[:n]
+		}
+		paths = []string{strings.Join(append(common, "*"), ".")}
+	}
+	provenance := make(map[string]string)
+	if value, ok := res.GetAnnotations()[fieldProvenanceAnnotation]; ok {
+		// a value that isn't valid is replaced
+		_ = json.Unmarshal([]byte(value), &provenance)
+	}
+	for _, path := range paths {
+		provenance[path] = p.provenanceSource()
+	}
+	value, err := json.Marshal(provenance)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if err := res.PipeE(kyaml.SetAnnotation(fieldProvenanceAnnotation, string(value))); err != nil {
+		return errors.WrapPrefixf(err, "annotating %s %s with the provenance of its fields", res.GetKind(), res.GetName())
+	}
+	return nil
+}
+
+// provenanceSource identifies the patch in fieldProvenanceAnnotation:
+// as patchSource does, but by a short hash of the text of a patch given
+// inline, which would otherwise be copied whole into the annotation.
+func (p *PatchTransformerPlugin) provenanceSource() string {
+	field, text := "patch", p.Patch
+	if p.SetExpr != "" {
+		field, text = "setExpr", p.SetExpr
+	}
+	if text == "" {
+		return p.patchSource
+	}
+	sum := sha256.Sum256([]byte(text))
+	return fmt.Sprintf("[%s: sha256:%x]", field, sum[:6])
+}
+
+// bracketKey returns the key as a segment of a path of visitScalars:
+// in brackets if it holds a dot.
+func bracketKey(key string) string {
+	if strings.Contains(key, ".") {
+		return "[" + key + "]"
+	}
+	return key
+}
+
+// unbracketKey returns the key of a segment of a path of visitScalars.
+func unbracketKey(segment string) string {
+	if key, ok := strings.CutPrefix(segment, "["); ok {
+		return strings.TrimSuffix(key, "]")
+	}
+	return segment
+}
+
+// pathSegments splits a path of visitScalars at the dots that aren't
+// within brackets.
+func pathSegments(path string) []string {
+	var segments []string
+	depth, start := 0, 0
+	for i, r := range path {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '.':
+			if depth == 0 {
+				segments = append(segments, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(segments, path[start:])
+}
+
+// mergeConfigMapData restores to the data of the patched ConfigMap the
+// keys of the original that the patch dropped, as when it replaced the
+// whole map, so that the patch's data is merged into the original's key
+// by key. Keys may thus be added or changed, but not removed, except
+// for those deleted, which the patch removed explicitly.
+func mergeConfigMapData(original *kyaml.RNode, res *resource.Resource, deleted map[string]bool) error {
+	if original == nil || res.GetKind() != "ConfigMap" {
+		return nil
+	}
+	before, _ := original.Pipe(kyaml.Lookup(kyaml.DataField))
+	if before == nil {
+		return nil
+	}
+	data, err := res.Pipe(kyaml.LookupCreate(kyaml.MappingNode, kyaml.DataField))
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return before.VisitFields(func(node *kyaml.MapNode) error {
+		key := node.Key.YNode().Value
+		if data.Field(key) != nil || deleted[key] {
+			return nil
+		}
+		return data.PipeE(kyaml.SetField(key, node.Value.Copy()))
+	})
+}
+
+// deletedDataKeys returns the keys of the data of the resource that the
+// patch removes explicitly: those a strategic merge patch sets to null,
+// and those a JSON patch removes.
+func (p *PatchTransformerPlugin) deletedDataKeys(res *resource.Resource) map[string]bool {
+	deleted := make(map[string]bool)
+	for _, patch := range p.smPatches {
+		if !p.targeted() && !patch.OrgId().Equals(res.OrgId()) {
+			continue
+		}
+		data, _ := patch.Pipe(kyaml.Lookup(kyaml.DataField))
+		if data == nil {
+			continue
+		}
+		_ = data.VisitFields(func(node *kyaml.MapNode) error {
+			if isNull(node.Value.YNode()) {
+				deleted[node.Key.YNode().Value] = true
+			}
+			return nil
+		})
+	}
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	for _, op := range p.jsonPatches {
+		path, err := op.Path()
+		if err != nil || op.Kind() != "remove" {
+			continue
+		}
+		if key, ok := strings.CutPrefix(path, "/"+kyaml.DataField+"/"); ok && !strings.Contains(key, "/") {
+			deleted[unescape.Replace(key)] = true
+		}
+	}
+	return deleted
+}
+
+// sortMapKeys sorts the fields of every map in node by key,
+// leaving the order of list elements as it is.
+func sortMapKeys(node *kyaml.Node) {
+	if node == nil {
+		return
+	}
+	if node.Kind == kyaml.MappingNode {
+		pairs := make([][2]*kyaml.Node, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			pairs = append(pairs, [2]*kyaml.Node{node.Content[i], node.Content[i+1]})
+		}
+		sort.SliceStable(pairs, func(i, j int) bool {
+			return pairs[i][0].Value < pairs[j][0].Value
+		})
+		for i, pair := range pairs {
+			node.Content[2*i], node.Content[2*i+1] = pair[0], pair[1]
+		}
+	}
+	for _, n := range node.Content {
+		sortMapKeys(n)
+	}
+}
+
+// coerceTypes coerces the fields named by CoerceTypes,
+// in each of the modified resources, to their given type.
+func (p *PatchTransformerPlugin) coerceTypes() error {
+	paths := make([]string, 0, len(p.CoerceTypes))
+	for path := range p.CoerceTypes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, res := range p.modified {
+		for _, path := range paths {
+			typ := p.CoerceTypes[path]
+			err := res.PipeE(fieldspec.Filter{
+				FieldSpec: types.FieldSpec{Path: path},
+				SetValue: func(node *kyaml.RNode) error {
+					return coerceScalar(node.YNode(), typ)
+				},
+			})
+			if err != nil {
+				return errors.WrapPrefixf(err, "coercing field %q to %s", path, typ)
+			}
+		}
+	}
+	return nil
+}
+
+// coerceScalar retags the scalar node as the given type,
+// after checking its value is valid for that type.
+func coerceScalar(node *kyaml.Node, typ string) error {
+	if node.Kind != kyaml.ScalarNode {
+		return fmt.Errorf("cannot coerce non-scalar value to %s", typ)
+	}
+	switch typ {
+	case "int":
+		if _, err := strconv.ParseInt(node.Value, 0, 64); err != nil {
+			return fmt.Errorf("value %q is not an int", node.Value)
+		}
+		node.Style = 0
+	case "bool":
+		b, err := strconv.ParseBool(node.Value)
+		if err != nil {
+			return fmt.Errorf("value %q is not a bool", node.Value)
+		}
+		node.Value = strconv.FormatBool(b)
+		node.Style = 0
+	case "string":
+		if node.ShortTag() != kyaml.NodeTagString {
+			node.Style = kyaml.DoubleQuotedStyle
+		}
+	}
+	node.Tag = coerceTags[typ]
+	return nil
+}
+
+// ApplyOrder returns the ids of the modified resources in an order
+// fit for applying them one by one: CustomResourceDefinitions come
+// before their custom resources, and Namespaces before the resources
+// in them. Resources otherwise keep the order in which they were
+// patched. It's an error if the dependencies form a cycle.
+func (p *PatchTransformerPlugin) ApplyOrder() ([]resid.ResId, error) {
+	n := len(p.modified)
+	dependents := make([][]int, n)
+	inDegree := make([]int, n)
+	for i, before := range p.modified {
+		for j, after := range p.modified {
+			if i != j && mustApplyBefore(before, after) {
+				dependents[i] = append(dependents[i], j)
+				inDegree[j]++
+			}
+		}
+	}
+	var ready []int
+	for i := range p.modified {
+		if inDegree[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	order := make([]resid.ResId, 0, n)
+	for len(ready) > 0 {
+		i := ready[0]
+		ready = ready[1:]
+		order = append(order, p.modified[i].CurId())
+		for _, j := range dependents[i] {
+			if inDegree[j]--; inDegree[j] == 0 {
+				// keep ready sorted, so ties go by patch order
+				k := sort.SearchInts(ready, j)
+				ready = append(ready[:k], append([]int{j}, ready[k:]...)...)
+			}
+		}
+	}
+	if len(order) < n {
+		var cyclic []string
+		for i, d := range inDegree {
+			if d > 0 {
+				cyclic = append(cyclic, p.modified[i].CurId().String())
+			}
+		}
+		return nil, fmt.Errorf(
+			"cannot order modified resources for applying, due to a dependency cycle among %s",
+			strings.Join(cyclic, ", "))
+	}
+	return order, nil
+}
+
+// mustApplyBefore reports whether the resource before must be applied
+// ahead of the resource after, either as the CustomResourceDefinition
+// of after, or as the Namespace holding it.
+func mustApplyBefore(before, after *resource.Resource) bool {
+	switch before.GetKind() {
+	case "CustomResourceDefinition":
+		group, _ := before.GetString("spec.group")
+		kind, _ := before.GetString("spec.names.kind")
+		gvk := after.GetGvk()
+		return kind != "" && gvk.Kind == kind && gvk.Group == group
+	case "Namespace":
+		return after.GetNamespace() != "" && after.GetNamespace() == before.GetName()
+	}
+	return false
+}
+
+// ChangelogLine returns a one-line summary of what the patch changed
+// in the resources it was applied to, e.g. "Set spec.replicas=3 on
+// Deployment/web; added label tier=frontend to 2 resources", or an
+// empty string if it changed nothing.
+func (p *PatchTransformerPlugin) ChangelogLine() string {
+	type clause struct {
+		change    fieldChange
+		resources []string
+	}
+	var clauses []*clause
+	index := make(map[fieldChange]*clause)
+	for _, res := range p.modified {
+		for _, change := range p.patchChanges(res) {
+			c, ok := index[change]
+			if !ok {
+				c = &clause{change: change}
+				index[change] = c
+				clauses = append(clauses, c)
+			}
+			c.resources = append(c.resources, res.GetKind()+"/"+res.GetName())
+		}
+	}
+	parts := make([]string, len(clauses))
+	for i, c := range clauses {
+		target := c.resources[0]
+		if len(c.resources) > 1 {
+			target = fmt.Sprintf("%d resources", len(c.resources))
+		}
+		parts[i] = c.change.String() + " " + target
+	}
+	line := strings.Join(parts, "; ")
+	if line == "" {
+		return ""
+	}
+	return strings.ToUpper(line[:1]) + line[1:]
+}
+
+// FieldChangeSummary maps the dot-separated path of each scalar field
+// the patch changed, e.g. spec.replicas or metadata.labels.[app.kubernetes.io/name],
+// to the number of modified resources in which it changed.
+func (p *PatchTransformerPlugin) FieldChangeSummary() map[string]int {
+	summary := make(map[string]int)
+	for _, res := range p.modified {
+		changed := make(map[string]bool)
+		for _, change := range p.patchChanges(res) {
+			changed[change.path] = true
+		}
+		for path := range changed {
+			summary[path]++
+		}
+	}
+	return summary
+}
+
+// MinimizePatch returns the patch without the operations, or fields,
+// that had no effect on the targets as they were before Transform,
+// because the targets already had the values they set.
+func (p *PatchTransformerPlugin) MinimizePatch() (string, error) {
+	if p.jsonPatches != nil {
+		return p.minimizeJson6902()
+	}
+	var documents []string
+	for _, patch := range p.smPatches {
+		var targets []*kyaml.RNode
+		for _, res := range p.modified {
+			if p.targeted() || patch.OrgId().Equals(res.OrgId()) {
+				targets = append(targets, p.originals[res])
+			}
+		}
+		minimized := patch.RNode.Copy()
+		minimizePatch(nil, minimized, targets, false)
+		documents = append(documents, minimized.MustString())
+	}
+	return strings.Join(documents, "---\n"), nil
+}
+
+// minimizeJson6902 returns the JSON patch without the operations
+// that changed none of the targets.
+func (p *PatchTransformerPlugin) minimizeJson6902() (string, error) {
+	effective := make([]bool, len(p.jsonPatches))
+	for _, res := range p.modified {
+		doc, err := p.originals[res].MarshalJSON()
+		if err != nil {
+			return "", errors.Wrap(err)
+		}
+		patch, _, err := p.resolvedPatch(p.originals[res])
+		if err != nil {
+			return "", err
+		}
+		for i, op := range patch {
+			next, err := jsonpatch.Patch{op}.Apply(doc)
+			if err != nil || !jsonpatch.Equal(doc, next) {
+				effective[i] = true
+			}
+			if err == nil {
+				doc = next
+			}
+		}
+	}
+	var ops jsonpatch.Patch
+	for i, op := range p.jsonPatches {
+		if effective[i] {
+			ops = append(ops, op)
+		}
+	}
+	minimized, err := json.Marshal(ops)
+	return string(minimized), errors.Wrap(err)
+}
+
+// minimizePatch removes from the strategic merge patch the fields that
+// all the targets already have with the same value, other than those
+// identifying the resource and the directives. It reports whether the
+// patch, or list element if element is set, has nothing left to change.
+// List elements are paired up by name, since that's the usual merge key.
+func minimizePatch(path []string, patch *kyaml.RNode, targets []*kyaml.RNode, element bool) bool {
+	if len(targets) == 0 {
+		return false
+	}
+	switch patch.YNode().Kind {
+	case kyaml.MappingNode:
+		unchanged := true
+		var redundant []string
+		_ = patch.VisitFields(func(node *kyaml.MapNode) error {
+			key := node.Key.YNode().Value
+			if strings.HasPrefix(key, "$") || isIdentifyingField(path, key) ||
+				(element && key == kyaml.NameField) {
+				return nil
+			}
+			var fields []*kyaml.RNode
+			for _, target := range targets {
+				field := target.Field(key)
+				if field == nil {
+					unchanged = false
+					return nil
+				}
+				fields = append(fields, field.Value)
+			}
+			if !minimizePatch(append(path[:len(path):len(path)], key), node.Value, fields, false) {
+				unchanged = false
+			} else if len(path) > 0 || key != kyaml.MetadataField {
+				// metadata is kept, for the name identifying the resource
+				redundant = append(redundant, key)
+			}
+			return nil
+		})
+		for _, key := range redundant {
+			_ = patch.PipeE(kyaml.Clear(key))
+		}
+		return unchanged
+	case kyaml.SequenceNode:
+		var kept []*kyaml.Node
+		for _, e := range patch.YNode().Content {
+			name := kyaml.NewRNode(e).Field(kyaml.NameField)
+			if e.Kind != kyaml.MappingNode || name == nil {
+				// without names to pair elements up by, only a list
+				// equal to those of all the targets is redundant
+				return !slices.ContainsFunc(targets, func(target *kyaml.RNode) bool {
+					return target.MustString() != patch.MustString()
+				})
+			}
+			var matches []*kyaml.RNode
+			for _, target := range targets {
+				if match, _ := target.Pipe(kyaml.MatchElement(kyaml.NameField, name.Value.YNode().Value)); match != nil {
+					matches = append(matches, match)
+				}
+			}
+			if len(matches) < len(targets) || !minimizePatch(path, kyaml.NewRNode(e), matches, true) {
+				kept = append(kept, e)
+			}
+		}
+		patch.YNode().Content = kept
+		return len(kept) == 0
+	default:
+		for _, target := range targets {
+			if target.YNode().Kind != kyaml.ScalarNode || target.YNode().Value != patch.YNode().Value {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// snippetFields are the fields that GenerateKustomizationSnippet
+// carries over, or that don't change what the patch does.
+var snippetFields = []string{ //nolint:gochecknoglobals
+	"path", "patch", "target", "options",
+	"loadTimeoutMs", "concurrency", "noColor",
+}
+
+// GenerateKustomizationSnippet returns a kustomization.yaml fragment
+// whose patches entry invokes this patch, inlining the patch it loaded
+// from Path. Only the patch, its target and its options carry over, so
+// a patch configured by other fields, which the entry would drop, can't
+// be expressed, but for those in snippetFields.
+func (p *PatchTransformerPlugin) GenerateKustomizationSnippet() ([]byte, error) {
+	switch {
+	case p.SetExpr != "":
+		return nil, fmt.Errorf("a patch by setExpr can't be expressed in a kustomization")
+	case p.MergeIntoEach != nil:
+		return nil, fmt.Errorf("a patch by mergeIntoEach can't be expressed in a kustomization")
+	case p.RemoveListItems != nil:
+		return nil, fmt.Errorf("a patch by removeListItems can't be expressed in a kustomization")
+	case len(p.TargetChain) > 0:
+		return nil, fmt.Errorf("a targetChain can't be expressed in a kustomization")
+	case len(p.Targets) > 0:
+		return nil, fmt.Errorf("targets can't be expressed in a kustomization")
+	}
+	// the fields set, by the names a config gives them
+	var fields map[string]interface{}
+	config, err := yaml.Marshal(p)
+	if err == nil {
+		err = yaml.Unmarshal(config, &fields)
+	}
+	if err != nil {
+		return nil, errors.WrapPrefixf(err, "reading the fields of patch %s", p.patchSource)
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !slices.Contains(snippetFields, name) {
+			return nil, fmt.Errorf("%s can't be expressed in a kustomization", name)
+		}
+	}
+	return kyaml.Marshal(map[string][]types.Patch{
+		"patches": {{
+			Patch:   strings.TrimSpace(p.patchText),
+			Target:  p.Target,
+			Options: p.Options,
+		}},
+	})
+}
+
+// RenderApplyCommands returns, for each resource the patch changed,
+// a kubectl command that would make the same change out-of-band: a
+// merge patch, or an apply of the whole resource if the patch changed
+// its name or kind. Resources whose change can't be computed, as they
+// don't serialize to JSON, are left out.
+func (p *PatchTransformerPlugin) RenderApplyCommands() []string {
+	var commands []string
+	for _, res := range p.modified {
+		if command, err := p.applyCommand(res); err == nil && command != "" {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// applyCommand returns the kubectl command of RenderApplyCommands for
+// the resource, or an empty string if the resource is unchanged.
+func (p *PatchTransformerPlugin) applyCommand(res *resource.Resource) (string, error) {
+	patched, err := withoutInternalAnnotations(&res.RNode)
+	if err != nil {
+		return "", err
+	}
+	patchedJSON, err := patched.MarshalJSON()
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	if !res.OrgId().Equals(res.CurId()) {
+		return fmt.Sprintf("echo %s | kubectl apply -f -", shellQuote(string(patchedJSON))), nil
+	}
+	original, err := withoutInternalAnnotations(p.originals[res])
+	if err != nil {
+		return "", err
+	}
+	originalJSON, err := original.MarshalJSON()
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	mergePatch, err := jsonpatch.CreateMergePatch(originalJSON, patchedJSON)
+	if err != nil {
+		return "", errors.WrapPrefixf(err, "computing the change to %s %s", res.GetKind(), res.GetName())
+	}
+	if string(mergePatch) == "{}" {
+		return "", nil
+	}
+	command := fmt.Sprintf("kubectl patch %s %s", kubectlResource(res.GetGvk()), res.GetName())
+	if ns := res.GetNamespace(); ns != "" {
+		command += " -n " + ns
+	}
+	return command + " --type merge -p " + shellQuote(string(mergePatch)), nil
+}
+
+// RenderModifiedJSON returns the resources the patch modified, as they
+// are now, as a JSON array, leaving out kustomize's internal annotations.
+func (p *PatchTransformerPlugin) RenderModifiedJSON() ([]byte, error) {
+	docs := []json.RawMessage{}
+	for _, res := range p.modified {
+		if res.IsNilOrEmpty() {
+			continue
+		}
+		node, err := withoutInternalAnnotations(&res.RNode)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := node.MarshalJSON()
+		if err != nil {
+			return nil, errors.WrapPrefixf(err, "rendering %s %s as JSON", res.GetKind(), res.GetName())
+		}
+		docs = append(docs, doc)
+	}
+	return json.Marshal(docs)
+}
+
+// RenderColorDiff returns a unified diff, of the YAML before and after,
+// of each resource the patch modified, leaving out kustomize's internal
+// annotations and the order of fields. Unless NoColor is set, added
+// lines are colored green and removed lines red, for display in a
+// terminal. Resources that don't serialize are left out.
+func (p *PatchTransformerPlugin) RenderColorDiff() string {
+	var b strings.Builder
+	for _, res := range p.modified {
+		before, errBefore := yamlLines(p.originals[res])
+		after, errAfter := yamlLines(&res.RNode)
+		if errBefore != nil || errAfter != nil {
+			continue
+		}
+		name := res.GetKind() + "/" + res.GetName()
+		writeDiff(&b, "--- "+name, "+++ "+name, before, after, !p.NoColor)
+	}
+	return b.String()
+}
+
+// PreviewLimited returns the diffs, without colors, of at most n of the
+// resources the patch modified, in the order it modified them, and
+// whether there were more, whose diffs it leaves uncomputed.
+func (p *PatchTransformerPlugin) PreviewLimited(n int) ([]PatchDiff, bool) {
+	modified := p.modified
+	truncated := len(modified) > n
+	if truncated {
+		modified = modified[:max(n, 0)]
+	}
+	diffs := make([]PatchDiff, 0, len(modified))
+	for _, res := range modified {
+		diff := PatchDiff{Id: res.CurId()}
+		before, errBefore := yamlLines(p.originals[res])
+		after, errAfter := yamlLines(&res.RNode)
+		if errBefore == nil && errAfter == nil {
+			var b strings.Builder
+			name := res.GetKind() + "/" + res.GetName()
+			writeDiff(&b, "--- "+name, "+++ "+name, before, after, false)
+			diff.Diff = b.String()
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, truncated
+}
+
+const (
+	diffContext = 3
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiCyan    = "\x1b[36m"
+	ansiReset   = "\x1b[0m"
+)
+
+// yamlLines returns the lines of the YAML of the node, with sorted
+// keys so that reordering fields changes nothing, and without
+// kustomize's internal annotations.
+func yamlLines(node *kyaml.RNode) ([]string, error) {
+	node, err := withoutInternalAnnotations(node)
+	if err != nil {
+		return nil, err
+	}
+	sortMapKeys(node.YNode())
+	text, err := node.String()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n"), nil
+}
+
+// writeDiff writes to b the hunks, with diffContext lines of context,
+// of the unified diff between the lines before and after, if they
+// differ, in ANSI colors if color is set.
+func writeDiff(b *strings.Builder, from, to string, before, after []string, color bool) {
+	// lcs[i][j] is the length of the longest common subsequence
+	// of before[i:] and after[j:].
+	lcs := make([][]int, len(before)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			if before[i] == after[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	type line struct {
+		op   byte
+		text string
+		i, j int
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(before) || j < len(after) {
+		switch {
+		case i < len(before) && j < len(after) && before[i] == after[j]:
+			lines = append(lines, line{' ', before[i], i, j})
+			i++
+			j++
+		case i < len(before) && (j == len(after) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', before[i], i, j})
+			i++
+		default:
+			lines = append(lines, line{'+', after[j], i, j})
+			j++
+		}
+	}
+	colored := func(code, text string) string {
+		if !color {
+			return text
+		}
+		return code + text + ansiReset
+	}
+	header := false
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+		// Extend the hunk until diffContext*2 unchanged lines in a row.
+		first := max(start-diffContext, 0)
+		end, unchanged := start, 0
+		for end < len(lines) && unchanged <= diffContext*2 {
+			if lines[end].op == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+			end++
+		}
+		end -= max(unchanged-diffContext, 0)
+		if !header {
+			b.WriteString(colored(ansiRed, from) + "\n")
+			b.WriteString(colored(ansiGreen, to) + "\n")
+			header = true
+		}
+		removed, added := 0, 0
+		for _, l := range lines[first:end] {
+			if l.op != '+' {
+				removed++
+			}
+			if l.op != '-' {
+				added++
+			}
+		}
+		b.WriteString(colored(ansiCyan, fmt.Sprintf("@@ -%d,%d +%d,%d @@",
+			lines[first].i+1, removed, lines[first].j+1, added)) + "\n")
+		for _, l := range lines[first:end] {
+			text := string(l.op) + l.text
+			switch l.op {
+			case '-':
+				text = colored(ansiRed, text)
+			case '+':
+				text = colored(ansiGreen, text)
+			}
+			b.WriteString(text + "\n")
+		}
+		start = end
+	}
+}
+
+// kubectlResource returns the kind.group form, lower-cased,
+// by which kubectl names resources of the given kind.
+func kubectlResource(gvk resid.Gvk) string {
+	name := strings.ToLower(gvk.Kind)
+	if gvk.Group != "" {
+		name += "." + gvk.Group
+	}
+	return name
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// BytesChanged returns the number of bytes the patch changed across
+// the resources it modified: for each, the bytes between the longest
+// common prefix and suffix of its serializations before and after,
+// counted in the longer of the two. Resources are serialized in JSON,
+// with sorted keys, so that reordering fields changes nothing.
+func (p *PatchTransformerPlugin) BytesChanged() int {
+	total := 0
+	for _, res := range p.modified {
+		before, after := canonicalJSON(p.originals[res]), canonicalJSON(&res.RNode)
+		prefix := 0
+		for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+			prefix++
+		}
+		suffix := 0
+		for suffix < len(before)-prefix && suffix < len(after)-prefix &&
+			before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+			suffix++
+		}
+		total += max(len(before), len(after)) - prefix - suffix
+	}
+	return total
+}
+
+// BlastRadius returns the resources the patch modified, along with
+// the other resources, of the ResMaps last transformed, that refer by
+// name to any of them, e.g. the workloads mounting a modified ConfigMap.
+// References are matched by the current or original name.
+func (p *PatchTransformerPlugin) BlastRadius() BlastReport {
+	var report BlastReport
+	names := make(map[string]bool)
+	for _, res := range p.modified {
+		report.DirectlyModified = append(report.DirectlyModified, res.CurId())
+		for _, id := range []resid.ResId{res.CurId(), res.OrgId()} {
+			names[id.Kind+"/"+id.EffectiveNamespace()+"/"+id.Name] = true
+		}
+	}
+	for _, m := range p.maps {
+		for _, res := range m.Resources() {
+			if p.isModified[res] {
+				continue
+			}
+			ns := res.CurId().EffectiveNamespace()
+			for _, ref := range objectRefs(res) {
+				if names[ref.kind+"/"+ns+"/"+ref.name] {
+					report.IndirectlyAffected = append(report.IndirectlyAffected, res.CurId())
+					break
+				}
+			}
+		}
+	}
+	return report
+}
+
+// DependencyGraph maps each resource the patch modified to the
+// resources it refers to by name, e.g. the ConfigMaps, Secrets and
+// service account of a workload. Referenced resources missing from the
+// ResMaps last transformed are identified by kind and name alone.
+func (p *PatchTransformerPlugin) DependencyGraph() map[resid.ResId][]resid.ResId {
+	graph := make(map[resid.ResId][]resid.ResId)
+	for _, res := range p.modified {
+		var deps []resid.ResId
+		for _, ref := range objectRefs(res) {
+			id := p.resolveRef(ref, res.CurId())
+			if !slices.Contains(deps, id) {
+				deps = append(deps, id)
+			}
+		}
+		graph[res.CurId()] = deps
+	}
+	return graph
+}
+
+// resolveRef returns the id of the resource, in the ResMaps last
+// transformed, that the reference from the resource with the given id
+// names.
+func (p *PatchTransformerPlugin) resolveRef(ref configRef, from resid.ResId) resid.ResId {
+	for _, m := range p.maps {
+		for _, res := range m.Resources() {
+			id := res.CurId()
+			if id.Kind == ref.kind && id.Name == ref.name &&
+				id.EffectiveNamespace() == from.EffectiveNamespace() {
+				return id
+			}
+		}
+	}
+	return resid.NewResIdWithNamespace(resid.Gvk{Kind: ref.kind}, ref.name, from.Namespace)
+}
+
+// objectRefs returns the references of the resource to others in its
+// namespace: those of its pod spec to ConfigMaps, Secrets, its service
+// account and persistent volume claims, and any other object naming
+// both the kind and name of the resource it refers to.
+func objectRefs(res *resource.Resource) []configRef {
+	var refs []configRef
+	if spec := podSpec(res); spec != nil {
+		refs = configRefs(spec)
+		if name, _ := spec.GetString("serviceAccountName"); name != "" {
+			refs = append(refs, configRef{kind: "ServiceAccount", name: name})
+		}
+		volumes, _ := spec.Pipe(kyaml.Lookup("volumes"))
+		if volumes != nil {
+			elements, _ := volumes.Elements()
+			for _, v := range elements {
+				if name, _ := v.GetString("persistentVolumeClaim.claimName"); name != "" {
+					refs = append(refs, configRef{kind: "PersistentVolumeClaim", name: name})
+				}
+			}
+		}
+	}
+	var visit func(node *kyaml.Node, top bool)
+	visit = func(node *kyaml.Node, top bool) {
+		if node.Kind == kyaml.MappingNode && !top {
+			rn := kyaml.NewRNode(node)
+			kind, _ := rn.GetString(kyaml.KindField)
+			name, _ := rn.GetString(kyaml.NameField)
+			if kind != "" && name != "" {
+				refs = append(refs, configRef{kind: kind, name: name})
+			}
+		}
+		for _, n := range node.Content {
+			visit(n, false)
+		}
+	}
+	visit(res.YNode(), true)
+	return refs
+}
+
+// fieldChange is a change the patch made to a scalar field.
+type fieldChange struct {
+	// op is one of set, added or removed.
+	op    string
+	path  string
+	value string
+}
+
+// String describes the change, ending in the preposition
+// that leads to the resource it was made to.
+func (c fieldChange) String() string {
+	field := c.path
+	if key, ok := strings.CutPrefix(c.path, "metadata.labels."); ok {
+		field = "label " + unbracketKey(key)
+	} else if key, ok := strings.CutPrefix(c.path, "metadata.annotations."); ok {
+		field = "annotation " + unbracketKey(key)
+	}
+	switch c.op {
+	case "added":
+		return fmt.Sprintf("added %s=%s to", field, c.value)
+	case "removed":
+		return fmt.Sprintf("removed %s from", field)
+	default:
+		return fmt.Sprintf("set %s=%s on", field, c.value)
+	}
+}
+
+// scalarChanges returns the changes made to the scalar fields of the
+// original resource to arrive at the patched one, in document order,
+// leaving out the internal annotations kustomize itself maintains.
+func scalarChanges(original, patched *kyaml.RNode) []fieldChange {
+	if original == nil {
+		return nil
+	}
+	internal := kioutil.GetInternalAnnotations(original)
+	for key, value := range kioutil.GetInternalAnnotations(patched) {
+		internal[key] = value
+	}
+	isInternal := func(path string) bool {
+		key, ok := strings.CutPrefix(path, "metadata.annotations.")
+		_, found := internal[unbracketKey(key)]
+		return ok && found
+	}
+	before := make(map[string]string)
+	visitScalars("", original.YNode(), func(path string, scalar *kyaml.Node) {
+		before[path] = scalar.Value
+	})
+	after := make(map[string]bool)
+	var changes []fieldChange
+	visitScalars("", patched.YNode(), func(path string, scalar *kyaml.Node) {
+		after[path] = true
+		if isInternal(path) {
+			return
+		}
+		if old, ok := before[path]; !ok {
+			changes = append(changes, fieldChange{op: "added", path: path, value: scalar.Value})
+		} else if old != scalar.Value {
+			changes = append(changes, fieldChange{op: "set", path: path, value: scalar.Value})
+		}
+	})
+	visitScalars("", original.YNode(), func(path string, scalar *kyaml.Node) {
+		if !after[path] && !isInternal(path) {
+			changes = append(changes, fieldChange{op: "removed", path: path})
+		}
+	})
+	return changes
+}
+
+// patchChanges returns the scalarChanges of the resource, leaving out
+// the annotations that the plugin itself adds after the patch.
+func (p *PatchTransformerPlugin) patchChanges(res *resource.Resource) []fieldChange {
+	own := []string{"metadata.annotations." + bracketKey(fieldProvenanceAnnotation)}
+	if p.SyncWave != nil {
+		key := p.SyncWaveAnnotation
+		if key == "" {
+			key = defaultSyncWaveAnnotation
+		}
+		own = append(own, "metadata.annotations."+bracketKey(key))
+	}
+	changes := scalarChanges(p.originals[res], &res.RNode)
+	return slices.DeleteFunc(changes, func(change fieldChange) bool {
+		return slices.Contains(own, change.path)
+	})
+}
+
+// trackModified records that the patch was applied to the resource,
+// unless the patch deleted it.
+func (p *PatchTransformerPlugin) trackModified(res *resource.Resource) {
+	if res.IsNilOrEmpty() || p.isModified[res] {
+		return
+	}
+	if p.isModified == nil {
+		p.isModified = make(map[*resource.Resource]bool)
+	}
+	p.isModified[res] = true
+	p.modified = append(p.modified, res)
+}
+
+// validate runs the validations enabled by Options against
+// the resources modified in each of the ResMaps.
+func (p *PatchTransformerPlugin) validate(maps []resmap.ResMap) error {
+	for _, res := range p.modified {
+		if err := p.validateResource(res, maps); err != nil {
+			return err
+		}
+	}
+	for _, m := range maps {
+		if p.Options["validateConfigRefs"] {
+			if err := p.validateConfigRefs(m); err != nil {
+				return err
+			}
+		}
+		if err := p.validateEnvRefs(m); err != nil {
+			return err
+		}
+		if p.Options["checkAgainstResourceQuota"] {
+			p.checkResourceQuotas(m)
+		}
+	}
+	return nil
+}
+
+// validation is a check of a resource, named by rule after the option
+// that enables it.
+type validation struct {
+	rule  string
+	check func(res *resource.Resource) error
+}
+
+// optionValidations returns the validations enabled by options,
+// in the order they run.
+func (p *PatchTransformerPlugin) optionValidations(maps []resmap.ResMap) []validation {
+	return []validation{
+		{"requireSingleContainer", p.validateSingleContainer},
+		{"requireProbes", p.validateProbes},
+		{"validateAgainstCRD", func(res *resource.Resource) error {
+			return p.validateAgainstCRD(res, maps)
+		}},
+		{"requireRollingUpdate", p.validateRollingUpdate},
+		{"requireSessionAffinity", p.validateSessionAffinity},
+		{"validateSelectorMatch", p.validateSelectorMatch},
+		{"validateAnnotationSize", p.validateAnnotationSize},
+		{"maxResultDepth", p.validateDepth},
+		{"rejectReservedAnnotations", p.validateReservedAnnotations},
+		{"validatePSS", p.validatePSS},
+		{"validateVolumeMounts", p.validateVolumeMounts},
+		{"validateInitOrder", func(res *resource.Resource) error {
+			// violations are noted, not errors
+			p.validateInitOrder(res)
+			return nil
+		}},
+	}
+}
+
+// validateResource runs the validations enabled by Options, and by the
+// fields that configure them, against the modified resource.
+func (p *PatchTransformerPlugin) validateResource(res *resource.Resource, maps []resmap.ResMap) error {
+	for _, v := range p.optionValidations(maps) {
+		if !p.option(res, v.rule) {
+			continue
+		}
+		if err := p.failed(res, v.rule, v.check(res)); err != nil {
+			return err
+		}
+	}
+	for _, group := range p.MutuallyExclusive {
+		if err := p.failed(res, "mutuallyExclusive", p.validateExclusive(res, group)); err != nil {
+			return err
+		}
+	}
+	if p.namePattern != nil && !p.namePattern.MatchString(res.GetName()) {
+		return p.failed(res, "namePattern", fmt.Errorf(
+			"%s %s doesn't match the name pattern %q after applying patch %s",
+			res.GetKind(), res.GetName(), p.NamePattern, p.patchSource))
+	}
+	if p.RequireOwnerLabel != "" && res.GetLabels()[p.RequireOwnerLabel] == "" {
+		return p.failed(res, "requireOwnerLabel", fmt.Errorf(
+			"%s %s has no owner label %q after applying patch %s",
+			res.GetKind(), res.GetName(), p.RequireOwnerLabel, p.patchSource))
+	}
+	if len(p.AllowedRegistries) > 0 {
+		if err := p.failed(res, "allowedRegistries", p.validateRegistries(res)); err != nil {
+			return err
+		}
+	}
+	if p.option(res, "rejectOversizedPatch") {
+		return p.failed(res, "rejectOversizedPatch", p.validatePatchSize(res))
+	}
+	return nil
+}
+
+// reset clears the state of the last transform, for the reports
+// of this one to cover only the ResMaps it's given.
+func (p *PatchTransformerPlugin) reset() {
+	p.notes = nil
+	p.fieldConflicts = nil
+	p.modified, p.isModified = nil, nil
+	p.originals = nil
+	p.targetOptions = nil
+	p.findings = nil
+	p.skipped = nil
+	p.maps = nil
+	p.chainTarget = nil
+}
+
+// assertDeterministic applies the patch twice, each time to copies of
+// the ResMaps and afresh, and checks that both give the same result.
+func (p *PatchTransformerPlugin) assertDeterministic(maps []resmap.ResMap) error {
+	var results [2][]resmap.ResMap
+	var errs [2]error
+	for i := range results {
+		results[i] = make([]resmap.ResMap, len(maps))
+		for j, m := range maps {
+			results[i][j] = m.DeepCopy()
+		}
+		errs[i] = p.trial(results[i])
+	}
+	if errs[0] != nil || errs[1] != nil {
+		if errs[0] != nil && errs[1] != nil {
+			// the patch fails either way, as Transform reports
+			return nil
+		}
+		err := errs[0]
+		if err == nil {
+			err = errs[1]
+		}
+		return fmt.Errorf(
+			"patch %s isn't deterministic: applied twice to the same input, it failed only once: %w",
+			p.patchSource, err)
+	}
+	for j := range maps {
+		first, second := results[0][j].Resources(), results[1][j].Resources()
+		if len(first) != len(second) {
+			return fmt.Errorf(
+				"patch %s isn't deterministic: applied twice to the same input, it left %d resources, then %d",
+				p.patchSource, len(first), len(second))
+		}
+		for k, res := range first {
+			if res.MustYaml() != second[k].MustYaml() {
+				return fmt.Errorf(
+					"patch %s isn't deterministic: applied twice to the same input, it gave different results for %s %s",
+					p.patchSource, res.GetKind(), res.GetName())
+			}
+		}
+	}
+	return nil
+}
+
+// trial applies the patch to the ResMaps afresh, for assertDeterministic,
+// by a copy of the plugin.
+func (p *PatchTransformerPlugin) trial(maps []resmap.ResMap) error {
+	trial := *p
+	trial.Options = make(map[string]bool, len(p.Options))
+	for name, value := range p.Options {
+		if name != "assertDeterministic" {
+			trial.Options[name] = value
+		}
+	}
+	trial.tracer = nil
+	return trial.transform(maps)
+}
+
+// missingCapabilities returns the required capabilities that
+// the target cluster doesn't offer.
+func (p *PatchTransformerPlugin) missingCapabilities() []string {
+	var missing []string
+	for _, c := range p.RequireCapabilities {
+		if !p.capabilities[c] {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// transformStrategicMerge applies each loaded strategic merge patch
+// to the resource in the ResMaps that matches the identifier of the patch.
+// If only one patch is specified, the Target can be used instead.
+func (p *PatchTransformerPlugin) transformStrategicMerge(maps []resmap.ResMap) error {
+	if p.targeted() {
+		if len(p.smPatches) > 1 {
+			// detail: https://github.com/kubernetes-sigs/kustomize/issues/5049#issuecomment-1440604403
+			return fmt.Errorf("Multiple Strategic-Merge Patches in one `patches` entry is not allowed to set `patches.target` field: %s", p.patchSource)
+		}
+		for _, m := range maps {
+			if err := p.transformStrategicMergeTarget(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, patch := range p.smPatches {
+		endSelect := p.startSpan("select")
+		target, err := getById(maps, patch.OrgId())
+		endSelect()
+		if err != nil {
+			return fmt.Errorf("no resource matches strategic merge patch %q: %w", patch.OrgId(), err)
+		}
+		if !p.kindAllowed(target) {
+			continue
+		}
+		p.snapshot(target)
+		p.recordFieldConflicts(target, patch)
+		smPatch := p.patchFor(target, patch)
+		if err := p.applySmPatch(target, smPatch, func() error {
+			return target.ApplySmPatch(smPatch)
+		}); err != nil {
+			return err
+		}
+		if err := applyElementOrder(p.elementOrders[patch], &target.RNode); err != nil {
+			return err
+		}
+		p.trackModified(target)
+	}
+	return nil
+}
+
+// selectTargets returns the resources in the ResMap that match Target,
+// or any of Targets.
+// With the option perDocument set to false, it's an error for Target
+// to match more than one document of the same file, as given by the
+// config.kubernetes.io/path annotation; resources without one, as under
+// kustomize build, aren't checked. Unlike the other options,
+// perDocument is on when unset. With the
+// option requireNamespace, it's an error for a Target that names a
+// namespace to match a resource without one, e.g. a cluster-scoped
+// resource matched by a namespace pattern, or a namespaced resource
+// taken to be in the default namespace. With the option
+// skipIncompatibleTargets, the resources that the patch doesn't fit
+// are left out, with a note, as are those of kinds not in AllowedKinds
+// or outside Group.
+func (p *PatchTransformerPlugin) selectTargets(m resmap.ResMap) ([]*resource.Resource, error) {
+	defer p.startSpan("select")()
+	matched, targets, err := p.match(m)
+	if err != nil {
+		return nil, err
+	}
+	var selected []*resource.Resource
+	for _, res := range matched {
+		if !p.kindAllowed(res) {
+			continue
+		}
+		if p.option(res, "skipIncompatibleTargets") {
+			if reason := p.incompatibility(res); reason != "" {
+				p.notes = append(p.notes, fmt.Sprintf(
+					"skipped %s %s, which patch %s doesn't fit: %s",
+					res.GetKind(), res.GetName(), p.patchSource, reason))
+				p.skip(res, "incompatible target: "+reason)
+				continue
+			}
+		}
+		selected = append(selected, res)
+	}
+	selected = p.newestApiVersions(selected)
+	for _, res := range selected {
+		if target := targets[res]; target.Namespace != "" && res.GetNamespace() == "" &&
+			p.option(res, "requireNamespace") {
+			return nil, fmt.Errorf(
+				"target %q of patch %s names namespace %q, but matches %s %s, which has no namespace",
+				target, p.patchSource, target.Namespace, res.GetKind(), res.GetName())
+		}
+	}
+	if perDocument, ok := p.Options["perDocument"]; !ok || perDocument {
+		return selected, nil
+	}
+	var paths []string
+	documents := make(map[string][]string)
+	for _, res := range selected {
+		path, _, _ := kioutil.GetFileAnnotations(&res.RNode)
+		if path == "" {
+			// not read from a file by kio, as under kustomize build,
+			// the resource can't be told to share a file with others
+			continue
+		}
+		if documents[path] == nil {
+			paths = append(paths, path)
+		}
+		documents[path] = append(documents[path], res.CurId().String())
+	}
+	for _, path := range paths {
+		if ids := documents[path]; len(ids) > 1 {
+			return nil, fmt.Errorf(
+				"target %q of patch %s ambiguously matches %d documents of file %q (%s); "+
+					"set the option perDocument to patch each of them",
+				p.targetString(), p.patchSource, len(ids), path, strings.Join(ids, ", "))
+		}
+	}
+	return selected, nil
+}
+
+// ExplainSelection returns, for each resource in the ResMap, "matched"
+// if Target, or any of Targets, matches it, or else "missed: " followed
+// by the first criterion of each selector that it fails, out of gvk,
+// name, namespace, labels and annotations, e.g. "missed: labels".
+// A TargetChain is explained by the selector Transform chose from it.
+// It returns nil if the patch has no target.
+func (p *PatchTransformerPlugin) ExplainSelection(m resmap.ResMap) map[resid.ResId]string {
+	selectors := p.Targets
+	if target := p.target(); target != nil {
+		selectors = []*types.Selector{target}
+	}
+	if len(selectors) == 0 {
+		return nil
+	}
+	explanation := make(map[resid.ResId]string)
+	for _, res := range m.Resources() {
+		var misses []string
+		for _, selector := range selectors {
+			miss := selectionMiss(selector, res)
+			if miss == "" {
+				misses = nil
+				break
+			}
+			misses = append(misses, miss)
+		}
+		explanation[res.CurId()] = "matched"
+		if len(misses) > 0 {
+			explanation[res.CurId()] = "missed: " + strings.Join(misses, ", ")
+		}
+	}
+	return explanation
+}
+
+// selectionMiss returns the first criterion of the selector, as
+// ExplainSelection names them, that the resource fails, or an empty
+// string if the selector matches it. Names and namespaces match if
+// either the original or the current one does, as in ResMap.Select.
+func selectionMiss(selector *types.Selector, res *resource.Resource) string {
+	sr, err := types.NewSelectorRegex(selector)
+	if err != nil {
+		return "invalid selector: " + err.Error()
+	}
+	if !sr.MatchGvk(res.GetGvk()) {
+		return "gvk"
+	}
+	if !sr.MatchName(res.OrgId().Name) && !sr.MatchName(res.CurId().Name) {
+		return "name"
+	}
+	if !sr.MatchNamespace(res.OrgId().EffectiveNamespace()) &&
+		!sr.MatchNamespace(res.CurId().EffectiveNamespace()) {
+		return "namespace"
+	}
+	matched, err := res.MatchesLabelSelector(selector.LabelSelector)
+	if err != nil {
+		return "invalid selector: " + err.Error()
+	}
+	if !matched {
+		return "labels"
+	}
+	matched, err = res.MatchesAnnotationSelector(selector.AnnotationSelector)
+	if err != nil {
+		return "invalid selector: " + err.Error()
+	}
+	if !matched {
+		return "annotations"
+	}
+	return ""
+}
+
+// newestApiVersions leaves out of the resources, with a note, those
+// with the option preferNewestApiVersion of which another is the same
+// resource, by kind, namespace and name, at a newer version, as when a
+// kind moves between groups, e.g. from extensions/v1beta1 to apps/v1.
+func (p *PatchTransformerPlugin) newestApiVersions(resources []*resource.Resource) []*resource.Resource {
+	newest := make(map[string]*resource.Resource)
+	key := func(res *resource.Resource) string {
+		return strings.Join([]string{res.GetKind(), res.GetNamespace(), res.GetName()}, "/")
+	}
+	for _, res := range resources {
+		if other, ok := newest[key(res)]; !ok || kubeVersionLess(other.GetGvk().Version, res.GetGvk().Version) {
+			newest[key(res)] = res
+		}
+	}
+	var kept []*resource.Resource
+	for _, res := range resources {
+		other := newest[key(res)]
+		if kubeVersionLess(res.GetGvk().Version, other.GetGvk().Version) && p.option(res, "preferNewestApiVersion") {
+			p.notes = append(p.notes, fmt.Sprintf(
+				"skipped %s %s at %s, as patch %s also matches it at the newer %s",
+				res.GetKind(), res.GetName(), res.GetApiVersion(), p.patchSource, other.GetApiVersion()))
+			p.skip(res, "newer apiVersion "+other.GetApiVersion()+" matched")
+			continue
+		}
+		kept = append(kept, res)
+	}
+	return kept
+}
+
+var kubeVersion = regexp.MustCompile(`^v(\d+)(?:(alpha|beta)(\d+))?$`) //nolint:gochecknoglobals
+
+// kubeVersionLess reports whether the version a comes before b in the
+// order Kubernetes gives API versions: after those not of the form
+// v<major>[alpha|beta<minor>], which go by name, come alphas, betas and
+// then GA versions, each by major and then minor version.
+func kubeVersionLess(a, b string) bool {
+	rank := func(v string) []int {
+		match := kubeVersion.FindStringSubmatch(v)
+		if match == nil {
+			return nil
+		}
+		major, _ := strconv.Atoi(match[1])
+		minor, _ := strconv.Atoi(match[3])
+		stability := map[string]int{"alpha": 1, "beta": 2, "": 3}[match[2]]
+		return []int{stability, major, minor}
+	}
+	rankA, rankB := rank(a), rank(b)
+	switch {
+	case rankA == nil && rankB == nil:
+		return a < b
+	case rankA == nil || rankB == nil:
+		return rankA == nil
+	}
+	return slices.Compare(rankA, rankB) < 0
+}
+
+// targeted reports whether the patch applies to the resources matching
+// Target, TargetChain or Targets, rather than to those it identifies.
+func (p *PatchTransformerPlugin) targeted() bool {
+	return p.Target != nil || len(p.TargetChain) > 0 || len(p.Targets) > 0
+}
+
+// target returns Target or, given a TargetChain, the selector of it
+// that Transform chose.
+func (p *PatchTransformerPlugin) target() *types.Selector {
+	if len(p.TargetChain) > 0 {
+		return p.chainTarget
+	}
+	return p.Target
+}
+
+// targetString describes, for messages, Target or Targets.
+func (p *PatchTransformerPlugin) targetString() string {
+	if len(p.Targets) == 0 {
+		return p.target().String()
+	}
+	targets := make([]string, len(p.Targets))
+	for i, target := range p.Targets {
+		targets[i] = target.String()
+	}
+	return strings.Join(targets, " or ")
+}
+
+// match returns the resources in the ResMap that match Target or, in
+// ResMap order and each once, any of Targets, along with the first
+// selector each matched. With the option errorOnOverlap, a resource
+// matching more than one of Targets is an error.
+func (p *PatchTransformerPlugin) match(m resmap.ResMap) ([]*resource.Resource, map[*resource.Resource]*types.Selector, error) {
+	selectors := p.Targets
+	if len(selectors) == 0 {
+		selectors = []*types.Selector{p.target()}
+	}
+	targets := make(map[*resource.Resource]*types.Selector)
+	for _, selector := range selectors {
+		matched, err := m.Select(*selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, res := range matched {
+			if first, ok := targets[res]; ok {
+				if p.option(res, "errorOnOverlap") {
+					return nil, nil, fmt.Errorf(
+						"%s %s matches both target %q and target %q of patch %s; "+
+							"unset the option errorOnOverlap to patch it once",
+						res.GetKind(), res.GetName(), first, selector, p.patchSource)
+				}
+				continue
+			}
+			targets[res] = selector
+		}
+	}
+	var matched []*resource.Resource
+	for _, res := range m.Resources() {
+		if _, ok := targets[res]; ok {
+			matched = append(matched, res)
+		}
+	}
+	return matched, targets, nil
+}
+
+// transformMergeIntoEach merges the patch of MergeIntoEach into each
+// element of the named list in all the resources that match Target.
+func (p *PatchTransformerPlugin) transformMergeIntoEach(m resmap.ResMap) error {
+	resources, err := p.selectTargets(m)
+	if err != nil {
+		return err
+	}
+	for _, res := range resources {
+		p.snapshot(res)
+		schema := listElementSchema(res, p.MergeIntoEach.ListPath)
+		err := res.PipeE(fieldspec.Filter{
+			FieldSpec: types.FieldSpec{Path: p.MergeIntoEach.ListPath},
+			SetValue: func(list *kyaml.RNode) error {
+				return p.mergeIntoElements(list, schema)
+			},
+		})
+		if err != nil {
+			return errors.WrapPrefixf(err, "applying patch %s", p.patchSource)
+		}
+		p.trackModified(res)
+	}
+	return nil
+}
+
+// transformRemoveListItems removes the elements matched by
+// RemoveListItems from the named list in all the resources that match
+// Target.
+func (p *PatchTransformerPlugin) transformRemoveListItems(m resmap.ResMap) error {
+	resources, err := p.selectTargets(m)
+	if err != nil {
+		return err
+	}
+	for _, res := range resources {
+		p.snapshot(res)
+		removed := false
+		err := res.PipeE(fieldspec.Filter{
+			FieldSpec: types.FieldSpec{Path: p.RemoveListItems.Path},
+			SetValue: func(list *kyaml.RNode) error {
+				if list.YNode().Kind != kyaml.SequenceNode {
+					return fmt.Errorf("expected a list at %q", p.RemoveListItems.Path)
+				}
+				var kept []*kyaml.Node
+				for _, element := range list.YNode().Content {
+					if p.matchesListItem(kyaml.NewRNode(element)) {
+						removed = true
+						continue
+					}
+					kept = append(kept, element)
+				}
+				list.YNode().Content = kept
+				return nil
+			},
+		})
+		if err != nil {
+			return errors.WrapPrefixf(err, "applying patch %s", p.patchSource)
+		}
+		if removed {
+			p.trackModified(res)
+		}
+	}
+	return nil
+}
+
+// matchesListItem tells whether the list element has all the field
+// values of RemoveListItems.
+func (p *PatchTransformerPlugin) matchesListItem(element *kyaml.RNode) bool {
+	if element.YNode().Kind != kyaml.MappingNode {
+		return false
+	}
+	for field, value := range p.RemoveListItems.Match {
+		if actual, err := element.GetString(field); err != nil || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// listElementSchema returns the schema of the elements of the list at
+// the slash-separated path in resources of the given one's type, or nil
+// if it isn't known.
+func listElementSchema(res *resource.Resource, path string) *openapi.ResourceSchema {
+	s := openapi.SchemaForResourceType(kyaml.TypeMeta{
+		APIVersion: res.GetApiVersion(),
+		Kind:       res.GetKind(),
+	})
+	for _, field := range utils.PathSplitter(path, "/") {
+		if s == nil || s.Schema == nil {
+			return nil
+		}
+		if elements := s.Elements(); elements != nil {
+			s = elements
+		}
+		s = s.Field(field)
+	}
+	if s == nil || s.Schema == nil {
+		return nil
+	}
+	return s.Elements()
+}
+
+// mergeIntoElements merges the patch of MergeIntoEach into each element
+// of the list, guided by the elements' schema if known.
+func (p *PatchTransformerPlugin) mergeIntoElements(list *kyaml.RNode, schema *openapi.ResourceSchema) error {
+	if list.YNode().Kind != kyaml.SequenceNode {
+		return fmt.Errorf("expected a list at %q", p.MergeIntoEach.ListPath)
+	}
+	elements, err := list.Elements()
+	if err != nil {
+		return err
+	}
+	for _, element := range elements {
+		merged, err := walk.Walker{
+			Sources: []*kyaml.RNode{element, p.elementPatch.Copy()},
+			Visitor: merge2.Merger{},
+			Schema:  schema,
+			MergeOptions: kyaml.MergeOptions{
+				ListIncreaseDirection: kyaml.MergeOptionsListPrepend,
+			},
+		}.Walk()
+		if err != nil {
+			return err
+		}
+		if merged != nil {
+			element.SetYNode(merged.YNode())
+		}
+	}
+	return nil
+}
+
+// getById returns the resource with the given id from the first
+// of the ResMaps that holds it.
+func getById(maps []resmap.ResMap, id resid.ResId) (*resource.Resource, error) {
+	err := fmt.Errorf("no resources to search for %s", id)
+	for _, m := range maps {
+		var res *resource.Resource
+		if res, err = m.GetById(id); err == nil {
+			return res, nil
+		}
+	}
+	return nil, err
+}
+
+// transformStrategicMergeTarget applies the single strategic merge
+// patch to all the resources in the ResMap that match Target.
+func (p *PatchTransformerPlugin) transformStrategicMergeTarget(m resmap.ResMap) error {
+	patch := p.smPatches[0]
+	selected, err := p.selectTargets(m)
+	if err != nil {
+		return fmt.Errorf("unable to find patch target %q in `resources`: %w", p.targetString(), err)
+	}
+	for _, res := range selected {
+		p.snapshot(res)
+		p.recordFieldConflicts(res, patch)
+		// each resource is patched apart, as its options may differ
+		smPatch := p.patchFor(res, patch)
+		if err := p.applySmPatch(res, smPatch, func() error {
+			return m.ApplySmPatch(resource.MakeIdSet([]*resource.Resource{res}), smPatch)
+		}); err != nil {
+			return err
+		}
+	}
+	for _, res := range selected {
+		if err := applyElementOrder(p.elementOrders[patch], &res.RNode); err != nil {
+			return err
+		}
+		p.trackModified(res)
+	}
+	return nil
+}
+
+// isKustomizeMeta reports whether the kind is that of a Kustomization
+// or Component, of any version.
+func isKustomizeMeta(gvk resid.Gvk) bool {
+	group, _ := resid.ParseGroupVersion(types.KustomizationVersion)
+	return gvk.Group == group && (gvk.Kind == types.KustomizationKind || gvk.Kind == types.ComponentKind)
+}
+
+// kindAllowed tells whether the patch may modify the resource, as its
+// kind is among AllowedKinds and its group is Group, if set, and, under
+// the option skipKustomizeMeta, isn't a Kustomization or Component,
+// noting it otherwise.
+func (p *PatchTransformerPlugin) kindAllowed(res *resource.Resource) bool {
+	if p.option(res, "skipKustomizeMeta") && isKustomizeMeta(res.GetGvk()) {
+		p.notes = append(p.notes, fmt.Sprintf(
+			"skipped %s %s, which is kustomize metadata rather than a resource for patch %s",
+			res.GetKind(), res.GetName(), p.patchSource))
+		p.skip(res, "kustomize metadata")
+		return false
+	}
+	if p.Group != "" && res.GetGvk().Group != p.Group {
+		p.notes = append(p.notes, fmt.Sprintf(
+			"skipped %s %s, as patch %s may only modify resources of group %s",
+			res.GetKind(), res.GetName(), p.patchSource, p.Group))
+		p.skip(res, "group not allowed")
+		return false
+	}
+	if len(p.AllowedKinds) == 0 || slices.Contains(p.AllowedKinds, res.GetKind()) {
+		return true
+	}
+	p.notes = append(p.notes, fmt.Sprintf(
+		"skipped %s %s, as patch %s may only modify %s",
+		res.GetKind(), res.GetName(), p.patchSource, strings.Join(p.AllowedKinds, ", ")))
+	p.skip(res, "kind not allowed")
+	return false
+}
+
+// skip records that the patch left the resource as it was,
+// and the reason why.
+func (p *PatchTransformerPlugin) skip(res *resource.Resource, reason string) {
+	if p.skipped == nil {
+		p.skipped = make(map[resid.ResId]string)
+	}
+	p.skipped[res.CurId()] = reason
+}
+
+// applySmPatch applies the strategic merge patch to the resource by
+// apply. If that fails and the option fallbackToJsonMerge is set, the
+// patch is instead merged into the resource as an RFC 7386 JSON merge
+// patch, which needs no schema, with a note. Under the option
+// treatUnknownAsMerge, resources of a type without a known schema, e.g.
+// those of aggregated APIs, are merged into that way to begin with.
+// Under the option allowApiVersionChange, the resource takes the
+// apiVersion that a patch of its kind gives, which the merge ignores.
+func (p *PatchTransformerPlugin) applySmPatch(res, patch *resource.Resource, apply func() error) (err error) {
+	if err := p.checkApiVersionChange(res, patch); err != nil {
+		return err
+	}
+	if version := patch.GetApiVersion(); version != "" && patch.GetKind() == res.GetKind() &&
+		p.option(res, "allowApiVersionChange") {
+		defer func() {
+			if err == nil && !res.IsNilOrEmpty() {
+				res.SetApiVersion(version)
+			}
+		}()
+	}
+	if err := p.checkSchema(res, patch); err != nil {
+		return err
+	}
+	if p.option(res, "initializeNullParents") {
+		initializeNullParents(res.YNode(), patch.YNode())
+	}
+	before := res.RNode.Copy()
+	if p.option(res, "treatUnknownAsMerge") && openapi.SchemaForResourceType(kyaml.TypeMeta{
+		APIVersion: res.GetApiVersion(),
+		Kind:       res.GetKind(),
+	}) == nil {
+		if patch.NameChangeAllowed() || patch.KindChangeAllowed() {
+			res.StorePreviousId()
+		}
+		return errors.WrapPrefixf(jsonMerge(res, before, patch), "merging patch %s", p.patchSource)
+	}
+	err = apply()
+	if err == nil || !p.option(res, "fallbackToJsonMerge") {
+		return errors.Wrap(err)
+	}
+	if mergeErr := jsonMerge(res, before, patch); mergeErr != nil {
+		return errors.Wrap(fmt.Errorf("%w; falling back to a JSON merge failed too: %v", err, mergeErr))
+	}
+	p.notes = append(p.notes, fmt.Sprintf(
+		"fell back to a JSON merge of patch %s into %s %s, as the strategic merge failed: %v",
+		p.patchSource, res.GetKind(), res.GetName(), err))
+	return nil
+}
+
+// checkApiVersionChange checks that the patch, if of the kind of the
+// resource, gives no apiVersion other than that of the resource, which
+// the merge would silently ignore, unless the option
+// allowApiVersionChange or allowKindChange is set. A patch of another
+// kind, as a Target may match many, applies whatever its apiVersion.
+func (p *PatchTransformerPlugin) checkApiVersionChange(res, patch *resource.Resource) error {
+	if version := patch.GetApiVersion(); version != "" && version != res.GetApiVersion() &&
+		patch.GetKind() == res.GetKind() &&
+		!patch.KindChangeAllowed() && !p.option(res, "allowApiVersionChange") {
+		return fmt.Errorf(
+			"patch %s has apiVersion %s, but targets %s %s of apiVersion %s; "+
+				"set option allowApiVersionChange to change the apiVersion",
+			p.patchSource, version, res.GetKind(), res.GetName(), res.GetApiVersion())
+	}
+	return nil
+}
+
+// checkSchema checks, if a schema registry is set, that it knows the
+// kind of the resource and, but for a nil patch, that the schema of the
+// kind has each field the patch sets.
+func (p *PatchTransformerPlugin) checkSchema(res, patch *resource.Resource) error {
+	if p.schemaRegistry == nil {
+		return nil
+	}
+	schema := p.schemaRegistry.Schema(res.GetGvk())
+	if schema == nil {
+		return fmt.Errorf("patch %s targets %s %s, but the schema registry doesn't know %s",
+			p.patchSource, res.GetKind(), res.GetName(), res.GetGvk())
+	}
+	if patch == nil {
+		return nil
+	}
+	if path := unknownField(nil, &patch.RNode, schema); path != "" {
+		return fmt.Errorf("patch %s sets %s on %s %s, but the schema of %s has no such field",
+			p.patchSource, path, res.GetKind(), res.GetName(), res.GetGvk())
+	}
+	return nil
+}
+
+// initializeNullParents turns each field of the target that is null,
+// where the patch holds an object, into an empty object for the patch
+// to merge into.
+func initializeNullParents(target, patch *kyaml.Node) {
+	if target.Kind != kyaml.MappingNode || patch.Kind != kyaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(patch.Content); i += 2 {
+		value := patch.Content[i+1]
+		if value.Kind != kyaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(target.Content); j += 2 {
+			if target.Content[j].Value != patch.Content[i].Value {
+				continue
+			}
+			if isNull(target.Content[j+1]) {
+				target.Content[j+1] = &kyaml.Node{Kind: kyaml.MappingNode, Tag: kyaml.NodeTagMap}
+			}
+			initializeNullParents(target.Content[j+1], value)
+		}
+	}
+}
+
+// initializeNullPaths turns each field that is null on the way to the
+// path of an operation of the patch into an empty list, where the path
+// goes on with an index, or else an empty object, for the operation to
+// apply to.
+func initializeNullPaths(node *kyaml.Node, patch jsonpatch.Patch) {
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	for _, op := range patch {
+		path, err := op.Path()
+		if err != nil {
+			continue
+		}
+		segments := strings.Split(path, "/")[1:]
+		current := node
+		for i := 0; i < len(segments)-1 && current != nil; i++ {
+			switch current.Kind {
+			case kyaml.MappingNode:
+				var child *kyaml.Node
+				for j := 0; j+1 < len(current.Content); j += 2 {
+					if current.Content[j].Value != unescape.Replace(segments[i]) {
+						continue
+					}
+					if isNull(current.Content[j+1]) {
+						current.Content[j+1] = &kyaml.Node{Kind: kyaml.MappingNode, Tag: kyaml.NodeTagMap}
+						if _, err := strconv.Atoi(segments[i+1]); err == nil || segments[i+1] == "-" {
+							current.Content[j+1] = &kyaml.Node{Kind: kyaml.SequenceNode, Tag: kyaml.NodeTagSeq}
+						}
+					}
+					child = current.Content[j+1]
+				}
+				current = child
+			case kyaml.SequenceNode:
+				index, err := strconv.Atoi(segments[i])
+				if err != nil || index < 0 || index >= len(current.Content) {
+					current = nil
+					break
+				}
+				current = current.Content[index]
+			default:
+				current = nil
+			}
+		}
+	}
+}
+
+// isNull reports whether the node is an explicit null.
+func isNull(node *kyaml.Node) bool {
+	return node.Kind == kyaml.ScalarNode && node.Tag == kyaml.NodeTagNull
+}
+
+// jsonMerge sets the resource to the JSON merge of the patch into
+// before, keeping the identity of before as a strategic merge would.
+func jsonMerge(res *resource.Resource, before *kyaml.RNode, patch *resource.Resource) error {
+	doc, err := before.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	patchNode, err := withoutInternalAnnotations(&patch.RNode)
+	if err != nil {
+		return err
+	}
+	patchJson, err := patchNode.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	merged, err := jsonpatch.MergePatch(doc, patchJson)
+	if err != nil {
+		return err
+	}
+	node, err := kyaml.ConvertJSONToYamlNode(string(merged))
+	if err != nil {
+		return err
+	}
+	res.SetYNode(node.YNode())
+	res.SetApiVersion(before.GetApiVersion())
+	if !patch.KindChangeAllowed() {
+		res.SetKind(before.GetKind())
+	}
+	if !patch.NameChangeAllowed() {
+		if err := res.SetName(before.GetName()); err != nil {
+			return err
+		}
+	}
+	return res.SetNamespace(before.GetNamespace())
+}
+
+// recordFieldConflicts notes each scalar field of the target that the
+// patch is about to override with a different value, if the option
+// reportFieldConflicts is set. The resource's identifying fields are
+// left out, as a targeted patch needn't repeat them.
+func (p *PatchTransformerPlugin) recordFieldConflicts(target, patch *resource.Resource) {
+	if !p.option(target, "reportFieldConflicts") {
+		return
+	}
+	var conflicts []Conflict
+	collectConflicts(nil, &target.RNode, &patch.RNode, &conflicts)
+	if len(conflicts) == 0 {
+		return
+	}
+	if p.fieldConflicts == nil {
+		p.fieldConflicts = make(map[string][]Conflict)
+	}
+	id := target.CurId().String()
+	p.fieldConflicts[id] = append(p.fieldConflicts[id], conflicts...)
+}
+
+// collectConflicts walks the patch alongside the target, appending a
+// Conflict for each scalar they both set to different values. List
+// elements are paired up by name, since that's the usual merge key.
+func collectConflicts(path []string, target, patch *kyaml.RNode, conflicts *[]Conflict) {
+	if target.IsNilOrEmpty() || patch.IsNilOrEmpty() ||
+		target.YNode().Kind != patch.YNode().Kind {
+		return
+	}
+	switch patch.YNode().Kind {
+	case kyaml.ScalarNode:
+		if target.YNode().Value != patch.YNode().Value {
+			*conflicts = append(*conflicts, Conflict{
+				Path:        strings.Join(path, "."),
+				TargetValue: target.YNode().Value,
+				PatchValue:  patch.YNode().Value,
+			})
+		}
+	case kyaml.MappingNode:
+		_ = patch.VisitFields(func(node *kyaml.MapNode) error {
+			key := node.Key.YNode().Value
+			if isIdentifyingField(path, key) {
+				return nil
+			}
+			if field := target.Field(key); field != nil {
+				collectConflicts(append(path[:len(path):len(path)], key),
+					field.Value, node.Value, conflicts)
+			}
+			return nil
+		})
+	case kyaml.SequenceNode:
+		elements, _ := patch.Elements()
+		for _, element := range elements {
+			name := element.Field("name")
+			if name == nil || len(path) == 0 {
+				continue
+			}
+			value := name.Value.YNode().Value
+			match, _ := target.Pipe(kyaml.MatchElement("name", value))
+			elementPath := append(path[:len(path)-1:len(path)-1],
+				fmt.Sprintf("%s[name=%s]", path[len(path)-1], value))
+			collectConflicts(elementPath, match, element, conflicts)
+		}
+	}
+}
+
+// isIdentifyingField reports whether the key, found at path, is one of
+// the fields that identify a resource rather than describe it.
+func isIdentifyingField(path []string, key string) bool {
+	switch len(path) {
+	case 0:
+		return key == kyaml.APIVersionField || key == kyaml.KindField
+	case 1:
+		return path[0] == kyaml.MetadataField &&
+			(key == kyaml.NameField || key == kyaml.NamespaceField)
+	}
+	return false
+}
+
+// setElementOrderPrefix prefixes the strategic merge directive that
+// fixes the order of the sibling list named by the rest of the key.
+const setElementOrderPrefix = "$setElementOrder/"
+
+// extractElementOrder strips all $setElementOrder directives from the
+// patch, since the merge itself doesn't understand them. It returns a
+// copy of the original patch for use by applyElementOrder, or nil if
+// the patch holds no such directive.
+func extractElementOrder(patch *kyaml.RNode) (*kyaml.RNode, error) {
+	order := patch.Copy()
+	if !stripElementOrder(patch.YNode()) {
+		return nil, nil
+	}
+	return order, nil
+}
+
+// stripElementOrder removes $setElementOrder directives from the node
+// and its descendants, reporting whether it removed any.
+func stripElementOrder(node *kyaml.Node) bool {
+	if node == nil {
+		return false
+	}
+	found := false
+	switch node.Kind {
+	case kyaml.MappingNode:
+		content := node.Content[:0]
+		for i := 0; i < len(node.Content); i += 2 {
+			if strings.HasPrefix(node.Content[i].Value, setElementOrderPrefix) {
+				found = true
+				continue
+			}
+			if stripElementOrder(node.Content[i+1]) {
+				found = true
+			}
+			content = append(content, node.Content[i], node.Content[i+1])
+		}
+		node.Content = content
+	case kyaml.SequenceNode, kyaml.DocumentNode:
+		for _, n := range node.Content {
+			if stripElementOrder(n) {
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+// applyElementOrder walks the patch alongside the merged target and,
+// wherever the patch holds a $setElementOrder directive, reorders the
+// corresponding list of the target to match it. Elements the directive
+// doesn't mention keep their relative order after the listed ones.
+func applyElementOrder(patch, target *kyaml.RNode) error {
+	if patch == nil || target.IsNilOrEmpty() {
+		return nil
+	}
+	switch patch.YNode().Kind {
+	case kyaml.MappingNode:
+		if target.YNode().Kind != kyaml.MappingNode {
+			return nil
+		}
+		return patch.VisitFields(func(node *kyaml.MapNode) error {
+			key := node.Key.YNode().Value
+			if list, ok := strings.CutPrefix(key, setElementOrderPrefix); ok {
+				if field := target.Field(list); field != nil {
+					reorderElements(field.Value.YNode(), node.Value.Content())
+				}
+				return nil
+			}
+			field := target.Field(key)
+			if field == nil {
+				return nil
+			}
+			return applyElementOrder(node.Value, field.Value)
+		})
+	case kyaml.SequenceNode:
+		if target.YNode().Kind != kyaml.SequenceNode {
+			return nil
+		}
+		elements, err := patch.Elements()
+		if err != nil {
+			return err
+		}
+		for _, element := range elements {
+			name := element.Field("name")
+			if name == nil {
+				continue
+			}
+			match, err := target.Pipe(kyaml.MatchElement("name", name.Value.YNode().Value))
+			if err != nil {
+				return err
+			}
+			if err := applyElementOrder(element, match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reorderElements sorts the elements of list into the given order.
+func reorderElements(list *kyaml.Node, order []*kyaml.Node) {
+	if list.Kind != kyaml.SequenceNode {
+		return
+	}
+	used := make([]bool, len(list.Content))
+	reordered := make([]*kyaml.Node, 0, len(list.Content))
+	for _, o := range order {
+		for i, element := range list.Content {
+			if !used[i] && elementMatchesOrder(element, o) {
+				used[i] = true
+				reordered = append(reordered, element)
+				break
+			}
+		}
+	}
+	for i, element := range list.Content {
+		if !used[i] {
+			reordered = append(reordered, element)
+		}
+	}
+	list.Content = reordered
+}
+
+// elementMatchesOrder reports whether the list element is the one named
+// by an entry of a $setElementOrder directive: either an equal scalar,
+// or a map holding all of the entry's merge key values.
+func elementMatchesOrder(element, entry *kyaml.Node) bool {
+	if entry.Kind == kyaml.ScalarNode {
+		return element.Kind == kyaml.ScalarNode && element.Value == entry.Value
+	}
+	if entry.Kind != kyaml.MappingNode || element.Kind != kyaml.MappingNode {
+		return false
+	}
+	for i := 0; i < len(entry.Content); i += 2 {
+		field := kyaml.NewRNode(element).Field(entry.Content[i].Value)
+		if field == nil || field.Value.YNode().Value != entry.Content[i+1].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// transformJson6902 applies json6902 Patch to all the resources in the ResMap that match Target.
+func (p *PatchTransformerPlugin) transformJson6902(m resmap.ResMap) error {
+	if !p.targeted() {
+		return fmt.Errorf("must specify a target for JSON patch %s", p.patchSource)
+	}
+	resources, err := p.selectTargets(m)
+	if err != nil {
+		return err
+	}
+	for _, res := range resources {
+		if err := p.checkSchema(res, nil); err != nil {
+			return err
+		}
+		p.snapshot(res)
+	}
+	// apart from the resource, applyJson6902 only reads the plugin
+	if err := p.forEach(resources, p.applyJson6902); err != nil {
+		return err
+	}
+	for _, res := range resources {
+		p.trackModified(res)
+	}
+	return nil
+}
+
+// applyJson6902 applies the JSON 6902 patch to the resource.
+func (p *PatchTransformerPlugin) applyJson6902(res *resource.Resource) error {
+	res.StorePreviousId()
+	internalAnnotations := kioutil.GetInternalAnnotations(&res.RNode)
+	patch, patchText, err := p.resolvedPatch(&res.RNode)
+	if err != nil {
+		return errors.WrapPrefixf(err, "resolving the paths of patch %s in %s %s",
+			p.patchSource, res.GetKind(), res.GetName())
+	}
+	if p.option(res, "initializeNullParents") {
+		initializeNullPaths(res.YNode(), patch)
+	}
+	preserveNumbers := p.option(res, "preserveNumericStyle")
+	if preserveNumbers {
+		// the patch goes through JSON, which rewrites numbers,
+		// e.g. 0.50 as 0.5, but leaves strings be
+		markNumbers(res.YNode())
+		// unmarked even if the patch fails, for no marker to be left behind
+		defer func() {
+			if node := res.YNode(); node != nil {
+				unmarkNumbers(node)
+			}
+		}()
+		if patchText, err = markPatchNumbers(patch, &res.RNode); err != nil {
+			return err
+		}
+	}
+	err = res.ApplyFilter(patchjson6902.Filter{
+		Patch: patchText,
+	})
+	if err != nil {
+		return err
+	}
+
+	annotations := res.GetAnnotations()
+	for key, value := range internalAnnotations {
+		annotations[key] = value
+	}
+	return errors.Wrap(res.SetAnnotations(annotations))
+}
+
+// forEach calls fn on each of the resources, in turn or, with a
+// Concurrency of more than 1, on that many at once, returning the
+// error of the first of them that fn fails on.
+func (p *PatchTransformerPlugin) forEach(resources []*resource.Resource, fn func(*resource.Resource) error) error {
+	if p.Concurrency <= 1 {
+		for _, res := range resources {
+			if err := fn(res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	errs := make([]error, len(resources))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(p.Concurrency, len(resources)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(resources[i])
+			}
+		}()
+	}
+	for i := range resources {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var keyedSegment = regexp.MustCompile(`^(.+)\[([^=\]]+)=([^\]]*)\]$`) //nolint:gochecknoglobals
+
+// resolvedPatch returns the JSON patch, and its text, with the keyed
+// segments of its paths resolved against the resource by resolveKeyedPaths.
+func (p *PatchTransformerPlugin) resolvedPatch(res *kyaml.RNode) (jsonpatch.Patch, string, error) {
+	resolved, err := resolveKeyedPaths(p.jsonPatches, res)
+	if err != nil || resolved == nil {
+		return p.jsonPatches, p.patchText, err
+	}
+	text, err := json.Marshal(resolved)
+	return resolved, string(text), errors.Wrap(err)
+}
+
+// resolveKeyedPaths returns the patch with each segment of its paths
+// that picks a list element by the value of one of its fields, e.g.
+// /spec/template/spec/containers[name=app]/image, replaced by the list
+// and the index of that element in the resource, or nil if no path has
+// such a segment. Paths are resolved against the resource as it is
+// before the patch, so operations mustn't move the elements later ones pick.
+func resolveKeyedPaths(patch jsonpatch.Patch, node *kyaml.RNode) (jsonpatch.Patch, error) {
+	var resolved jsonpatch.Patch
+	for i, op := range patch {
+		for _, key := range []string{"path", "from"} {
+			if op[key] == nil {
+				continue
+			}
+			var path string
+			if err := json.Unmarshal(*op[key], &path); err != nil {
+				return nil, errors.WrapPrefixf(err, "decoding the %s of a JSON patch operation", key)
+			}
+			if !strings.Contains(path, "[") {
+				continue
+			}
+			indexed, err := resolveKeyedPath(path, node)
+			if err != nil {
+				return nil, err
+			}
+			if resolved == nil {
+				resolved = make(jsonpatch.Patch, len(patch))
+				for j, op := range patch {
+					resolved[j] = make(jsonpatch.Operation, len(op))
+					for key, value := range op {
+						resolved[j][key] = value
+					}
+				}
+			}
+			raw, err := json.Marshal(indexed)
+			if err != nil {
+				return nil, errors.Wrap(err)
+			}
+			message := json.RawMessage(raw)
+			resolved[i][key] = &message
+		}
+	}
+	return resolved, nil
+}
+
+// resolveKeyedPath returns the JSON pointer with each of its keyed
+// segments, e.g. containers[name=app], replaced by the list and the
+// index of the element of the node it picks, e.g. containers/1.
+func resolveKeyedPath(path string, node *kyaml.RNode) (string, error) {
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	segments := strings.Split(path, "/")
+	for i := 1; i < len(segments); i++ {
+		match := keyedSegment.FindStringSubmatch(segments[i])
+		key := segments[i]
+		if match != nil {
+			key = match[1]
+		}
+		node = childAt(node, unescape.Replace(key))
+		if match == nil {
+			continue
+		}
+		if node == nil || node.YNode().Kind != kyaml.SequenceNode {
+			return "", fmt.Errorf("%s in path %s isn't a list", key, path)
+		}
+		elements, _ := node.Elements()
+		index := slices.IndexFunc(elements, func(element *kyaml.RNode) bool {
+			field := element.Field(match[2])
+			return field != nil && field.Value.YNode().Value == match[3]
+		})
+		if index < 0 {
+			return "", fmt.Errorf("no element of %s has %s=%s, as path %s requires",
+				key, match[2], match[3], path)
+		}
+		node = elements[index]
+		segments[i] = key + "/" + strconv.Itoa(index)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// childAt returns the field of a map, or the element of a list at the
+// index, that key names, or nil if there's none.
+func childAt(node *kyaml.RNode, key string) *kyaml.RNode {
+	if node == nil {
+		return nil
+	}
+	switch node.YNode().Kind {
+	case kyaml.MappingNode:
+		if field := node.Field(key); field != nil {
+			return field.Value
+		}
+	case kyaml.SequenceNode:
+		elements, _ := node.Elements()
+		if index, err := strconv.Atoi(key); err == nil && index >= 0 && index < len(elements) {
+			return elements[index]
+		}
+	}
+	return nil
+}
+
+// markNumbers turns each number in the node into a string of its
+// representation prefixed by numericMarker.
+func markNumbers(node *kyaml.Node) {
+	if node.Kind == kyaml.ScalarNode {
+		if tag := node.ShortTag(); tag == kyaml.NodeTagInt || tag == kyaml.NodeTagFloat {
+			node.Value = numericMarker + node.Value
+			node.Tag = kyaml.NodeTagString
+			node.Style = kyaml.DoubleQuotedStyle
+		}
+		return
+	}
+	for _, n := range node.Content {
+		markNumbers(n)
+	}
+}
+
+// unmarkNumbers turns back into numbers the strings that markNumbers,
+// or markPatchNumbers, made of them.
+func unmarkNumbers(node *kyaml.Node) {
+	if node.Kind == kyaml.ScalarNode {
+		if value, ok := strings.CutPrefix(node.Value, numericMarker); ok {
+			plain := kyaml.Node{Kind: kyaml.ScalarNode, Value: value}
+			node.Value = value
+			node.Tag = plain.ShortTag()
+			node.Style = 0
+		}
+		return
+	}
+	for _, n := range node.Content {
+		unmarkNumbers(n)
+	}
+}
+
+// markPatchNumbers returns the JSON patch, as text, with each number
+// in the values of its operations turned into a string of its
+// representation prefixed by numericMarker. The numbers a test
+// operation compares with those of the target, which markNumbers
+// has marked, take on the target's representation where they're equal,
+// for the test to pass or fail as it would unmarked.
+func markPatchNumbers(patch jsonpatch.Patch, target *kyaml.RNode) (string, error) {
+	var mark func(v interface{}, tested *kyaml.RNode) interface{}
+	mark = func(v interface{}, tested *kyaml.RNode) interface{} {
+		switch v := v.(type) {
+		case json.Number:
+			if tested != nil && equalNumbers(v.String(), tested.YNode().Value) {
+				return tested.YNode().Value
+			}
+			return numericMarker + v.String()
+		case map[string]interface{}:
+			for key, value := range v {
+				v[key] = mark(value, childAt(tested, key))
+			}
+		case []interface{}:
+			for i, value := range v {
+				v[i] = mark(value, childAt(tested, strconv.Itoa(i)))
+			}
+		}
+		return v
+	}
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	marked := make(jsonpatch.Patch, len(patch))
+	for i, op := range patch {
+		marked[i] = make(jsonpatch.Operation, len(op))
+		for key, value := range op {
+			marked[i][key] = value
+		}
+		if op["value"] == nil {
+			continue
+		}
+		var tested *kyaml.RNode
+		if path, err := op.Path(); err == nil && op.Kind() == "test" {
+			tested = target
+			for _, segment := range strings.Split(path, "/")[1:] {
+				tested = childAt(tested, unescape.Replace(segment))
+			}
+		}
+		decoder := json.NewDecoder(bytes.NewReader(*op["value"]))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return "", errors.WrapPrefixf(err, "decoding the value of a JSON patch operation")
+		}
+		raw, err := json.Marshal(mark(value, tested))
+		if err != nil {
+			return "", errors.Wrap(err)
+		}
+		message := json.RawMessage(raw)
+		marked[i]["value"] = &message
+	}
+	text, err := json.Marshal(marked)
+	return string(text), errors.Wrap(err)
+}
+
+// equalNumbers reports whether the number of a test operation is equal
+// to the one that markNumbers marked as the test compares them unmarked,
+// that is, to the marked number as converted to JSON.
+func equalNumbers(number, marked string) bool {
+	value, ok := strings.CutPrefix(marked, numericMarker)
+	if !ok {
+		return false
+	}
+	node := kyaml.Node{Kind: kyaml.ScalarNode, Value: value}
+	node.Tag = node.ShortTag()
+	var decoded interface{}
+	if err := node.Decode(&decoded); err != nil {
+		return false
+	}
+	converted, err := json.Marshal(decoded)
+	return err == nil && string(converted) == number
+}
+
+// configRef is a workload's reference to a ConfigMap or Secret.
+type configRef struct {
+	kind string
+	name string
+	// key is the referenced key of an env var's valueFrom.
+	key      string
+	optional bool
+}
+
+// podSpec returns the pod spec of a workload, that is, of a Pod or of
+// any resource holding a pod template, or nil if res isn't a workload.
+func podSpec(res *resource.Resource) *kyaml.RNode {
+	if res.GetKind() == "Pod" {
+		spec, _ := res.Pipe(kyaml.Lookup("spec"))
+		return spec
+	}
+	for _, path := range [][]string{
+		{"spec", "template", "spec"},
+		{"spec", "jobTemplate", "spec", "template", "spec"},
+	} {
+		if spec, _ := res.Pipe(kyaml.Lookup(path...)); spec != nil {
+			return spec
+		}
+	}
+	return nil
+}
+
+// podContainers returns the containers and init containers of a pod spec.
+func podContainers(spec *kyaml.RNode) []*kyaml.RNode {
+	var containers []*kyaml.RNode
+	for _, field := range []string{"initContainers", "containers"} {
+		list, _ := spec.Pipe(kyaml.Lookup(field))
+		if list == nil {
+			continue
+		}
+		elements, _ := list.Elements()
+		containers = append(containers, elements...)
+	}
+	return containers
+}
+
+// configRefs returns the ConfigMaps and Secrets referenced by a pod spec.
+func configRefs(spec *kyaml.RNode) []configRef {
+	var refs []configRef
+	add := func(node *kyaml.RNode, kind, nameField string) {
+		if node == nil {
+			return
+		}
+		name, _ := node.GetString(nameField)
+		if name == "" {
+			return
+		}
+		key, _ := node.GetString("key")
+		optional, _ := node.Pipe(kyaml.Lookup("optional"))
+		refs = append(refs, configRef{
+			kind:     kind,
+			name:     name,
+			key:      key,
+			optional: optional != nil && optional.YNode().Value == "true",
+		})
+	}
+	lookup := func(node *kyaml.RNode, path ...string) *kyaml.RNode {
+		found, _ := node.Pipe(kyaml.Lookup(path...))
+		return found
+	}
+	volumes, _ := spec.Pipe(kyaml.Lookup("volumes"))
+	if volumes != nil {
+		elements, _ := volumes.Elements()
+		for _, v := range elements {
+			add(lookup(v, "configMap"), "ConfigMap", "name")
+			add(lookup(v, "secret"), "Secret", "secretName")
+			sources, _ := v.Pipe(kyaml.Lookup("projected", "sources"))
+			if sources == nil {
+				continue
+			}
+			projected, _ := sources.Elements()
+			for _, source := range projected {
+				add(lookup(source, "configMap"), "ConfigMap", "name")
+				add(lookup(source, "secret"), "Secret", "name")
+			}
+		}
+	}
+	for _, c := range podContainers(spec) {
+		if envFrom := lookup(c, "envFrom"); envFrom != nil {
+			elements, _ := envFrom.Elements()
+			for _, e := range elements {
+				add(lookup(e, "configMapRef"), "ConfigMap", "name")
+				add(lookup(e, "secretRef"), "Secret", "name")
+			}
+		}
+		if env := lookup(c, "env"); env != nil {
+			elements, _ := env.Elements()
+			for _, e := range elements {
+				add(lookup(e, "valueFrom", "configMapKeyRef"), "ConfigMap", "name")
+				add(lookup(e, "valueFrom", "secretKeyRef"), "Secret", "name")
+			}
+		}
+	}
+	return refs
+}
+
+// findConfig returns the ConfigMap or Secret of the given kind and
+// name in the namespace, or nil if the ResMap holds no such resource.
+func findConfig(m resmap.ResMap, kind, name, namespace string) *resource.Resource {
+	for _, r := range m.Resources() {
+		if r.GetKind() == kind && r.GetName() == name &&
+			r.GetNamespace() == namespace {
+			return r
+		}
+	}
+	return nil
+}
+
+// validateConfigRefs checks that every ConfigMap and Secret referenced
+// by a workload still resolves to a resource in the ResMap, for each
+// workload that the patch modified or that references, by its original
+// name, a ConfigMap or Secret that the patch modified.
+func (p *PatchTransformerPlugin) validateConfigRefs(m resmap.ResMap) error {
+	originalNames := make(map[string]bool)
+	for _, r := range p.modified {
+		if kind := r.OrgId().Kind; kind == "ConfigMap" || kind == "Secret" {
+			originalNames[kind+"/"+r.OrgId().Name] = true
+		}
+	}
+	for _, r := range m.Resources() {
+		spec := podSpec(r)
+		if spec == nil {
+			continue
+		}
+		refs := configRefs(spec)
+		if !p.isModified[r] && !referencesAny(refs, originalNames) {
+			continue
+		}
+		for _, ref := range refs {
+			if ref.optional || findConfig(m, ref.kind, ref.name, r.GetNamespace()) != nil {
+				continue
+			}
+			return p.failed(r, "validateConfigRefs", fmt.Errorf(
+				"%s %s references %s %q, which isn't among the resources, after applying patch %s",
+				r.GetKind(), r.GetName(), ref.kind, ref.name, p.patchSource))
+		}
+	}
+	return nil
+}
+
+// validateEnvRefs checks that every key referenced by the env vars of
+// the modified workloads, through a configMapKeyRef or secretKeyRef,
+// is present in a ConfigMap or Secret in the ResMap, for the workloads
+// whose options set validateEnvRefs.
+func (p *PatchTransformerPlugin) validateEnvRefs(m resmap.ResMap) error {
+	for _, r := range m.Resources() {
+		if !p.isModified[r] || !p.option(r, "validateEnvRefs") {
+			continue
+		}
+		spec := podSpec(r)
+		if spec == nil {
+			continue
+		}
+		for _, ref := range configRefs(spec) {
+			if ref.key == "" || ref.optional {
+				continue
+			}
+			config := findConfig(m, ref.kind, ref.name, r.GetNamespace())
+			if config == nil {
+				return p.failed(r, "validateEnvRefs", fmt.Errorf(
+					"%s %s references key %q of %s %q, which isn't among the resources, after applying patch %s",
+					r.GetKind(), r.GetName(), ref.key, ref.kind, ref.name, p.patchSource))
+			}
+			if !hasDataKey(config, ref.key) {
+				return p.failed(r, "validateEnvRefs", fmt.Errorf(
+					"%s %s references key %q of %s %q, which has no such key, after applying patch %s",
+					r.GetKind(), r.GetName(), ref.key, ref.kind, ref.name, p.patchSource))
+			}
+		}
+	}
+	return nil
+}
+
+// checkResourceQuotas notes each compute resource that, after the patch,
+// the modified workloads in the namespace of a ResourceQuota among the
+// resources together request, or are limited to, more of than the quota
+// allows. Each workload counts for as many pods as its replicas.
+func (p *PatchTransformerPlugin) checkResourceQuotas(m resmap.ResMap) {
+	for _, quota := range m.Resources() {
+		if quota.GetKind() != "ResourceQuota" {
+			continue
+		}
+		hard, _ := quota.Pipe(kyaml.Lookup("spec", "hard"))
+		if hard == nil {
+			continue
+		}
+		totals := p.workloadResources(m, quota.GetNamespace())
+		_ = hard.VisitFields(func(field *kyaml.MapNode) error {
+			name, allowed := field.Key.YNode().Value, field.Value.YNode().Value
+			limit, ok := parseQuantity(allowed)
+			if !ok {
+				return nil
+			}
+			// a quota on cpu or memory alone is on their requests
+			total, ok := totals[name]
+			if !ok {
+				total = totals["requests."+name]
+			}
+			if total > limit {
+				message := fmt.Sprintf(
+					"patch %s brings %s of the modified workloads in namespace %q to %s, "+
+						"more than the %s allowed by ResourceQuota %s",
+					p.patchSource, name, quota.GetNamespace(),
+					strconv.FormatFloat(total, 'f', -1, 64), allowed, quota.GetName())
+				p.notes = append(p.notes, message)
+				p.find(SeverityWarn, quota, "checkAgainstResourceQuota", message)
+			}
+			return nil
+		})
+	}
+}
+
+// workloadResources sums, by the names a ResourceQuota gives them
+// (e.g. requests.cpu), the compute resources requested by, and the
+// limits of, the containers of the modified workloads in the namespace,
+// times their replicas.
+func (p *PatchTransformerPlugin) workloadResources(m resmap.ResMap, namespace string) map[string]float64 {
+	totals := make(map[string]float64)
+	for _, res := range m.Resources() {
+		if !p.isModified[res] || res.GetNamespace() != namespace {
+			continue
+		}
+		spec := podSpec(res)
+		if spec == nil {
+			continue
+		}
+		replicas := 1
+		if node, _ := res.Pipe(kyaml.Lookup("spec", "replicas")); node != nil {
+			if n, err := strconv.Atoi(node.YNode().Value); err == nil {
+				replicas = n
+			}
+		}
+		containers, _ := spec.Pipe(kyaml.Lookup("containers"))
+		if containers == nil {
+			continue
+		}
+		elements, _ := containers.Elements()
+		for _, container := range elements {
+			for _, section := range []string{"requests", "limits"} {
+				quantities, _ := container.Pipe(kyaml.Lookup("resources", section))
+				if quantities == nil {
+					continue
+				}
+				_ = quantities.VisitFields(func(field *kyaml.MapNode) error {
+					if quantity, ok := parseQuantity(field.Value.YNode().Value); ok {
+						totals[section+"."+field.Key.YNode().Value] += quantity * float64(replicas)
+					}
+					return nil
+				})
+			}
+		}
+	}
+	return totals
+}
+
+var quantitySuffixes = []struct { //nolint:gochecknoglobals
+	suffix     string
+	multiplier float64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40}, {"Pi", 1 << 50}, {"Ei", 1 << 60},
+	{"n", 1e-9}, {"u", 1e-6}, {"m", 1e-3}, {"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12}, {"P", 1e15}, {"E", 1e18},
+}
+
+// parseQuantity returns the value of a Kubernetes quantity,
+// e.g. 500m or 2Gi, and whether it is one.
+func parseQuantity(s string) (float64, bool) {
+	multiplier := 1.0
+	for _, unit := range quantitySuffixes {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSuffix(s, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return value * multiplier, true
+}
+
+// hasDataKey reports whether the ConfigMap or Secret holds the key.
+func hasDataKey(config *resource.Resource, key string) bool {
+	for _, field := range []string{"data", "binaryData", "stringData"} {
+		if value, _ := config.Pipe(kyaml.Lookup(field, key)); value != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSingleContainer checks that the workload,
+// if it is one, has no more than one container.
+func (p *PatchTransformerPlugin) validateSingleContainer(res *resource.Resource) error {
+	spec := podSpec(res)
+	if spec == nil {
+		return nil
+	}
+	containers, _ := spec.Pipe(kyaml.Lookup("containers"))
+	if containers == nil {
+		return nil
+	}
+	if n := len(containers.Content()); n > 1 {
+		return fmt.Errorf(
+			"%s %s has %d containers after applying patch %s, but a single container is required",
+			res.GetKind(), res.GetName(), n, p.patchSource)
+	}
+	return nil
+}
+
+// validateProbes checks that each container of the workload,
+// if it is one, has both a liveness and a readiness probe.
+func (p *PatchTransformerPlugin) validateProbes(res *resource.Resource) error {
+	spec := podSpec(res)
+	if spec == nil {
+		return nil
+	}
+	containers, _ := spec.Pipe(kyaml.Lookup("containers"))
+	if containers == nil {
+		return nil
+	}
+	elements, _ := containers.Elements()
+	for _, c := range elements {
+		for _, probe := range []string{"livenessProbe", "readinessProbe"} {
+			if c.Field(probe) == nil {
+				name, _ := c.GetString(kyaml.NameField)
+				return fmt.Errorf(
+					"%s %s has container %s without a %s after applying patch %s",
+					res.GetKind(), res.GetName(), name, probe, p.patchSource)
+			}
+		}
+	}
+	return nil
+}
+
+// validateAgainstCRD checks the custom resource, if its
+// CustomResourceDefinition is in one of the ResMaps, against the
+// OpenAPI schema that the definition gives its version.
+func (p *PatchTransformerPlugin) validateAgainstCRD(res *resource.Resource, maps []resmap.ResMap) error {
+	crd, schema := crdSchema(maps, res.GetGvk())
+	if schema == nil {
+		return nil
+	}
+	var violations []string
+	fields, _ := res.Fields()
+	for _, field := range fields {
+		if field == kyaml.APIVersionField || field == kyaml.KindField || field == kyaml.MetadataField {
+			continue
+		}
+		violations = append(violations, fieldViolations(schema, res.Field(field), "")...)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"%s %s doesn't conform to CustomResourceDefinition %s after applying patch %s: %s",
+		res.GetKind(), res.GetName(), crd, p.patchSource, strings.Join(violations, "; "))
+}
+
+// crdSchema returns the name of the CustomResourceDefinition, in
+// the ResMaps, of resources of the given type, and the OpenAPI schema
+// it gives their version, or nil if there's none.
+func crdSchema(maps []resmap.ResMap, gvk resid.Gvk) (string, *kyaml.RNode) {
+	for _, m := range maps {
+		for _, crd := range m.Resources() {
+			if crd.GetKind() != "CustomResourceDefinition" {
+				continue
+			}
+			group, _ := crd.GetString("spec.group")
+			kind, _ := crd.GetString("spec.names.kind")
+			if group != gvk.Group || kind != gvk.Kind {
+				continue
+			}
+			versions, _ := crd.Pipe(kyaml.Lookup("spec", "versions"))
+			if versions == nil {
+				continue
+			}
+			elements, _ := versions.Elements()
+			for _, version := range elements {
+				if name, _ := version.GetString(kyaml.NameField); name != gvk.Version {
+					continue
+				}
+				schema, _ := version.Pipe(kyaml.Lookup("schema", "openAPIV3Schema"))
+				if schema != nil {
+					return crd.GetName(), schema
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// fieldViolations returns the ways in which the field of the object at
+// the dot-separated path violates the object's schema.
+func fieldViolations(schema *kyaml.RNode, field *kyaml.MapNode, path string) []string {
+	key := field.Key.YNode().Value
+	name := key
+	if path != "" {
+		name = path + "." + key
+	}
+	properties := schema.Field("properties")
+	if properties != nil {
+		if fieldSchema := properties.Value.Field(key); fieldSchema != nil {
+			return schemaViolations(fieldSchema.Value, field.Value, name)
+		}
+	}
+	if additional := schema.Field("additionalProperties"); additional != nil {
+		if additional.Value.YNode().Kind == kyaml.MappingNode {
+			return schemaViolations(additional.Value, field.Value, name)
+		}
+		if additional.Value.YNode().Value == "true" {
+			return nil
+		}
+	}
+	// an object schema declaring no properties leaves its fields free
+	if preserve, _ := schema.GetString("x-kubernetes-preserve-unknown-fields"); properties == nil || preserve == "true" {
+		return nil
+	}
+	return []string{name + " is not declared by the schema"}
+}
+
+// schemaViolations returns the ways in which the value at the
+// dot-separated path violates the schema: by its type, enum, required
+// fields, undeclared fields, and those of its fields and elements.
+func schemaViolations(schema, value *kyaml.RNode, path string) []string {
+	if value.IsNil() || value.YNode().Tag == kyaml.NodeTagNull {
+		return nil
+	}
+	node := value.YNode()
+	typ, _ := schema.GetString("type")
+	if intOrString, _ := schema.GetString("x-kubernetes-int-or-string"); intOrString == "true" {
+		typ = ""
+	}
+	if want, ok := map[string]kyaml.Kind{
+		"object": kyaml.MappingNode,
+		"array":  kyaml.SequenceNode,
+	}[typ]; ok && node.Kind != want {
+		return []string{fmt.Sprintf("%s must be of type %s", path, typ)}
+	}
+	if tags, ok := map[string][]string{
+		"string":  {kyaml.NodeTagString},
+		"integer": {kyaml.NodeTagInt},
+		"number":  {kyaml.NodeTagInt, kyaml.NodeTagFloat},
+		"boolean": {kyaml.NodeTagBool},
+	}[typ]; ok && (node.Kind != kyaml.ScalarNode || !slices.Contains(tags, node.ShortTag())) {
+		return []string{fmt.Sprintf("%s must be of type %s", path, typ)}
+	}
+	var violations []string
+	if enum := schema.Field("enum"); enum != nil && node.Kind == kyaml.ScalarNode {
+		var allowed []string
+		for _, e := range enum.Value.YNode().Content {
+			allowed = append(allowed, e.Value)
+		}
+		if !slices.Contains(allowed, node.Value) {
+			violations = append(violations, fmt.Sprintf(
+				"%s must be one of %s", path, strings.Join(allowed, ", ")))
+		}
+	}
+	switch node.Kind {
+	case kyaml.MappingNode:
+		required, _ := schema.Pipe(kyaml.Lookup("required"))
+		if required != nil {
+			for _, r := range required.YNode().Content {
+				if value.Field(r.Value) == nil {
+					violations = append(violations, fmt.Sprintf("%s.%s is required", path, r.Value))
+				}
+			}
+		}
+		_ = value.VisitFields(func(field *kyaml.MapNode) error {
+			violations = append(violations, fieldViolations(schema, field, path)...)
+			return nil
+		})
+	case kyaml.SequenceNode:
+		items, _ := schema.Pipe(kyaml.Lookup("items"))
+		if items == nil {
+			break
+		}
+		for i, element := range node.Content {
+			violations = append(violations,
+				schemaViolations(items, kyaml.NewRNode(element), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return violations
+}
+
+// validateExclusive checks that each object of the resource at the
+// common path of the group's fields sets at most one of them.
+func (p *PatchTransformerPlugin) validateExclusive(res *resource.Resource, group []string) error {
+	if len(group) < 2 {
+		return nil
+	}
+	var paths [][]string
+	for _, path := range group {
+		paths = append(paths, utils.PathSplitter(path, "/"))
+	}
+	// the fields are grouped under the longest common path of their parents
+	common := 0
+	for ; common < len(paths[0])-1; common++ {
+		if slices.ContainsFunc(paths, func(path []string) bool {
+			return len(path) <= common+1 || path[common] != paths[0][common]
+		}) {
+			break
+		}
+	}
+	for _, parent := range nodesAt(&res.RNode, paths[0][:common]) {
+		var set []string
+		for i, path := range paths {
+			if len(nodesAt(parent, path[common:])) > 0 {
+				set = append(set, group[i])
+			}
+		}
+		if len(set) > 1 {
+			return fmt.Errorf(
+				"%s %s sets %s, of which at most one may be set, after applying patch %s",
+				res.GetKind(), res.GetName(), strings.Join(set, " and "), p.patchSource)
+		}
+	}
+	return nil
+}
+
+// nodesAt returns the non-null nodes at the path, whose fields are
+// looked up in maps, and in each element of lists.
+func nodesAt(node *kyaml.RNode, path []string) []*kyaml.RNode {
+	if node.IsNil() || node.YNode().Tag == kyaml.NodeTagNull {
+		return nil
+	}
+	if node.YNode().Kind == kyaml.SequenceNode {
+		var nodes []*kyaml.RNode
+		elements, _ := node.Elements()
+		for _, element := range elements {
+			nodes = append(nodes, nodesAt(element, path)...)
+		}
+		return nodes
+	}
+	if len(path) == 0 {
+		return []*kyaml.RNode{node}
+	}
+	field := node.Field(path[0])
+	if field == nil {
+		return nil
+	}
+	return nodesAt(field.Value, path[1:])
+}
+
+// validateSessionAffinity checks that the Service, if it is one, has
+// the SessionAffinity required, taking an unset one to be None, the default.
+func (p *PatchTransformerPlugin) validateSessionAffinity(res *resource.Resource) error {
+	if res.GetKind() != "Service" {
+		return nil
+	}
+	required := p.SessionAffinity
+	if required == "" {
+		required = "ClientIP"
+	}
+	affinity, _ := res.GetString("spec.sessionAffinity")
+	if affinity == "" {
+		affinity = "None"
+	}
+	if affinity != required {
+		return fmt.Errorf(
+			"%s %s has session affinity %s after applying patch %s, but %s is required",
+			res.GetKind(), res.GetName(), affinity, p.patchSource, required)
+	}
+	return nil
+}
+
+// validateRollingUpdate checks that the Deployment, if it is one,
+// is updated by the RollingUpdate strategy, which is the default.
+func (p *PatchTransformerPlugin) validateRollingUpdate(res *resource.Resource) error {
+	if res.GetKind() != "Deployment" {
+		return nil
+	}
+	strategy, _ := res.GetString("spec.strategy.type")
+	if strategy != "" && strategy != "RollingUpdate" {
+		return fmt.Errorf(
+			"%s %s has strategy %s after applying patch %s, but RollingUpdate is required",
+			res.GetKind(), res.GetName(), strategy, p.patchSource)
+	}
+	return nil
+}
+
+// validateSelectorMatch checks that the matchLabels of the workload's
+// selector, if it has one, match the labels of its pod template, as
+// the API server requires.
+func (p *PatchTransformerPlugin) validateSelectorMatch(res *resource.Resource) error {
+	matchLabels, _ := res.Pipe(kyaml.Lookup("spec", "selector", "matchLabels"))
+	if matchLabels == nil {
+		return nil
+	}
+	template, _ := res.Pipe(kyaml.Lookup("spec", "template"))
+	if template == nil {
+		return nil
+	}
+	labels := template.GetLabels()
+	keys, err := matchLabels.Fields()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, _ := matchLabels.GetString(key)
+		if actual, ok := labels[key]; !ok || actual != value {
+			return fmt.Errorf(
+				"%s %s selects pods by label %s=%s, which its pod template doesn't have, after applying patch %s",
+				res.GetKind(), res.GetName(), key, value, p.patchSource)
+		}
+	}
+	return nil
+}
+
+// changedAnnotations returns, sorted, the keys of the annotations that
+// the patch added to the resource or changed, leaving out the internal
+// annotations kustomize itself maintains.
+func (p *PatchTransformerPlugin) changedAnnotations(res *resource.Resource) []string {
+	before := map[string]string{}
+	if original := p.originals[res]; original != nil {
+		before = original.GetAnnotations()
+	}
+	internal := kioutil.GetInternalAnnotations(&res.RNode)
+	var changed []string
+	for key, value := range res.GetAnnotations() {
+		if _, ok := internal[key]; ok {
+			continue
+		}
+		if old, ok := before[key]; !ok || old != value {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// reservedAnnotationDomains are the domains, along with their
+// subdomains, under which Kubernetes reserves annotation keys.
+var reservedAnnotationDomains = []string{"kubernetes.io", "k8s.io"} //nolint:gochecknoglobals
+
+// pluginAnnotations are the annotations, under a reserved domain, that
+// the plugin itself reads or writes, which rejectReservedAnnotations
+// lets a patch set.
+var pluginAnnotations = []string{fieldProvenanceAnnotation, initOrderAnnotation} //nolint:gochecknoglobals
+
+// isReservedAnnotation reports whether the annotation key's prefix
+// is in one of the reserved domains.
+func isReservedAnnotation(key string) bool {
+	prefix, _, found := strings.Cut(key, "/")
+	if !found {
+		return false
+	}
+	for _, domain := range reservedAnnotationDomains {
+		if prefix == domain || strings.HasSuffix(prefix, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAnnotationSize checks that the annotations of the resource,
+// other than the internal ones kustomize itself maintains, don't exceed
+// the total size that the API server accepts.
+func (p *PatchTransformerPlugin) validateAnnotationSize(res *resource.Resource) error {
+	internal := kioutil.GetInternalAnnotations(&res.RNode)
+	size := 0
+	for key, value := range res.GetAnnotations() {
+		if _, ok := internal[key]; !ok {
+			size += len(key) + len(value)
+		}
+	}
+	if size > maxAnnotationsSize {
+		return fmt.Errorf(
+			"%s %s has annotations of %d bytes after applying patch %s, more than the %d bytes allowed",
+			res.GetKind(), res.GetName(), size, p.patchSource, maxAnnotationsSize)
+	}
+	return nil
+}
+
+// validateDepth checks that the resource doesn't nest maps and lists
+// more than MaxResultDepth levels deep.
+func (p *PatchTransformerPlugin) validateDepth(res *resource.Resource) error {
+	limit := p.MaxResultDepth
+	if limit == 0 {
+		limit = defaultMaxResultDepth
+	}
+	if depth := nodeDepth(res.YNode()); depth > limit {
+		return fmt.Errorf(
+			"%s %s nests %d levels deep after applying patch %s, more than the %d allowed",
+			res.GetKind(), res.GetName(), depth, p.patchSource, limit)
+	}
+	return nil
+}
+
+// nodeDepth returns how many levels of maps and lists the node nests,
+// counting the node itself: 0 for a scalar, 1 for a map of scalars.
+func nodeDepth(node *kyaml.Node) int {
+	if node.Kind != kyaml.MappingNode && node.Kind != kyaml.SequenceNode {
+		return 0
+	}
+	deepest := 0
+	for _, child := range node.Content {
+		deepest = max(deepest, nodeDepth(child))
+	}
+	return deepest + 1
+}
+
+// validateReservedAnnotations checks that the patch set no annotation
+// under a reserved prefix, other than those explicitly allowed.
+func (p *PatchTransformerPlugin) validateReservedAnnotations(res *resource.Resource) error {
+	for _, key := range p.changedAnnotations(res) {
+		if !isReservedAnnotation(key) || slices.Contains(pluginAnnotations, key) ||
+			slices.Contains(p.AllowedReservedAnnotations, key) {
+			continue
+		}
+		return fmt.Errorf(
+			"patch %s sets annotation %q on %s %s, but its prefix is reserved by Kubernetes",
+			p.patchSource, key, res.GetKind(), res.GetName())
+	}
+	return nil
+}
+
+// validatePSS checks the workload, if it is one, against the Pod
+// Security Standard of PSSLevel, noting any violations, or failing on
+// them if the option failOnPSSViolation is set.
+func (p *PatchTransformerPlugin) validatePSS(res *resource.Resource) error {
+	spec := podSpec(res)
+	if spec == nil {
+		return nil
+	}
+	level := p.PSSLevel
+	if level == "" {
+		level = "baseline"
+	}
+	violations := pssViolations(spec, level)
+	if len(violations) == 0 {
+		return nil
+	}
+	message := fmt.Sprintf(
+		"%s %s violates the %s Pod Security Standard after applying patch %s: %s",
+		res.GetKind(), res.GetName(), level, p.patchSource, strings.Join(violations, "; "))
+	if p.option(res, "failOnPSSViolation") {
+		return fmt.Errorf("%s", message)
+	}
+	p.notes = append(p.notes, message)
+	p.find(SeverityWarn, res, "validatePSS", message)
+	return nil
+}
+
+// baselineCapabilities are the capabilities that containers may add
+// under the baseline Pod Security Standard.
+var baselineCapabilities = []string{ //nolint:gochecknoglobals
+	"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD",
+	"NET_BIND_SERVICE", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT",
+}
+
+// pssViolations returns the ways in which the pod spec violates
+// the baseline or restricted Pod Security Standard.
+func pssViolations(spec *kyaml.RNode, level string) []string {
+	var violations []string
+	for _, field := range []string{"hostNetwork", "hostPID", "hostIPC"} {
+		if scalarAt(spec, field) == "true" {
+			violations = append(violations, field+" is true")
+		}
+	}
+	volumes, _ := spec.Pipe(kyaml.Lookup("volumes"))
+	if volumes != nil {
+		elements, _ := volumes.Elements()
+		for _, v := range elements {
+			if hostPath, _ := v.Pipe(kyaml.Lookup("hostPath")); hostPath != nil {
+				violations = append(violations, fmt.Sprintf("volume %s is a hostPath", scalarAt(v, "name")))
+			}
+		}
+	}
+	if level == "restricted" && scalarAt(spec, "securityContext", "runAsUser") == "0" {
+		violations = append(violations, "runAsUser is 0")
+	}
+	for _, c := range podContainers(spec) {
+		violations = append(violations, containerPSSViolations(spec, c, level)...)
+	}
+	return violations
+}
+
+// containerPSSViolations returns the ways in which a container of the
+// pod spec violates the baseline or restricted Pod Security Standard.
+func containerPSSViolations(spec, c *kyaml.RNode, level string) []string {
+	var violations []string
+	container := "container " + scalarAt(c, "name")
+	if scalarAt(c, "securityContext", "privileged") == "true" {
+		violations = append(violations, container+" is privileged")
+	}
+	ports, _ := c.Pipe(kyaml.Lookup("ports"))
+	if ports != nil {
+		elements, _ := ports.Elements()
+		for _, port := range elements {
+			if hostPort := scalarAt(port, "hostPort"); hostPort != "" && hostPort != "0" {
+				violations = append(violations, fmt.Sprintf("%s uses hostPort %s", container, hostPort))
+			}
+		}
+	}
+	for _, capability := range listAt(c, "securityContext", "capabilities", "add") {
+		allowed := slices.Contains(baselineCapabilities, capability)
+		if level == "restricted" {
+			allowed = capability == "NET_BIND_SERVICE"
+		}
+		if !allowed {
+			violations = append(violations, fmt.Sprintf("%s adds capability %s", container, capability))
+		}
+	}
+	if level != "restricted" {
+		return violations
+	}
+	if scalarAt(c, "securityContext", "allowPrivilegeEscalation") != "false" {
+		violations = append(violations, container+" doesn't set allowPrivilegeEscalation to false")
+	}
+	if runAsNonRoot := scalarAt(c, "securityContext", "runAsNonRoot"); runAsNonRoot != "true" &&
+		(runAsNonRoot != "" || scalarAt(spec, "securityContext", "runAsNonRoot") != "true") {
+		violations = append(violations, container+" doesn't set runAsNonRoot to true")
+	}
+	if scalarAt(c, "securityContext", "runAsUser") == "0" {
+		violations = append(violations, container+" sets runAsUser to 0")
+	}
+	if !slices.Contains(listAt(c, "securityContext", "capabilities", "drop"), "ALL") {
+		violations = append(violations, container+" doesn't drop capability ALL")
+	}
+	seccomp := scalarAt(c, "securityContext", "seccompProfile", "type")
+	if seccomp == "" {
+		seccomp = scalarAt(spec, "securityContext", "seccompProfile", "type")
+	}
+	if seccomp != "RuntimeDefault" && seccomp != "Localhost" {
+		violations = append(violations, container+" doesn't set seccompProfile type RuntimeDefault or Localhost")
+	}
+	return violations
+}
+
+// scalarAt returns the value of the scalar at the path in the node,
+// or an empty string if there's none.
+func scalarAt(node *kyaml.RNode, path ...string) string {
+	found, _ := node.Pipe(kyaml.Lookup(path...))
+	if found == nil || found.YNode().Kind != kyaml.ScalarNode {
+		return ""
+	}
+	return found.YNode().Value
+}
+
+// listAt returns the values of the elements of the list at the path
+// in the node.
+func listAt(node *kyaml.RNode, path ...string) []string {
+	found, _ := node.Pipe(kyaml.Lookup(path...))
+	if found == nil {
+		return nil
+	}
+	var values []string
+	for _, n := range found.YNode().Content {
+		values = append(values, n.Value)
+	}
+	return values
+}
+
+// validateVolumeMounts checks that each volume mounted by the
+// workload's containers, if it is a workload, is declared in its pod spec.
+func (p *PatchTransformerPlugin) validateVolumeMounts(res *resource.Resource) error {
+	spec := podSpec(res)
+	if spec == nil {
+		return nil
+	}
+	volumes := make(map[string]bool)
+	if list, _ := spec.Pipe(kyaml.Lookup("volumes")); list != nil {
+		elements, _ := list.Elements()
+		for _, v := range elements {
+			name, _ := v.GetString(kyaml.NameField)
+			volumes[name] = true
+		}
+	}
+	for _, c := range podContainers(spec) {
+		mounts, _ := c.Pipe(kyaml.Lookup("volumeMounts"))
+		if mounts == nil {
+			continue
+		}
+		elements, _ := mounts.Elements()
+		for _, mount := range elements {
+			if name, _ := mount.GetString(kyaml.NameField); !volumes[name] {
+				container, _ := c.GetString(kyaml.NameField)
+				return fmt.Errorf(
+					"%s %s has container %s mount volume %q, which isn't declared, after applying patch %s",
+					res.GetKind(), res.GetName(), container, name, p.patchSource)
+			}
+		}
+	}
+	return nil
+}
+
+// validateInitOrder notes the init containers of the workload that
+// run out of the order declared by its initOrderAnnotation.
+func (p *PatchTransformerPlugin) validateInitOrder(res *resource.Resource) {
+	declared := res.GetAnnotations()[initOrderAnnotation]
+	spec := podSpec(res)
+	if declared == "" || spec == nil {
+		return
+	}
+	list, _ := spec.Pipe(kyaml.Lookup("initContainers"))
+	if list == nil {
+		return
+	}
+	position := make(map[string]int)
+	elements, _ := list.Elements()
+	for i, c := range elements {
+		name, _ := c.GetString(kyaml.NameField)
+		position[name] = i
+	}
+	var previous string
+	for _, name := range strings.Split(declared, ",") {
+		name = strings.TrimSpace(name)
+		i, ok := position[name]
+		if !ok {
+			continue
+		}
+		if previous != "" && i < position[previous] {
+			message := fmt.Sprintf(
+				"%s %s runs init container %s before %s, against the order %q declared by %s, after applying patch %s",
+				res.GetKind(), res.GetName(), name, previous, declared, initOrderAnnotation, p.patchSource)
+			p.notes = append(p.notes, message)
+			p.find(SeverityWarn, res, "validateInitOrder", message)
+		}
+		previous = name
+	}
+}
+
+// validateRegistries checks that each image that the patch set or
+// changed on the workload's containers is from an allowed registry.
+func (p *PatchTransformerPlugin) validateRegistries(res *resource.Resource) error {
+	spec := podSpec(res)
+	if spec == nil {
+		return nil
+	}
+	before := make(map[string]string)
+	if original := p.originals[res]; original != nil {
+		if spec := podSpec(&resource.Resource{RNode: *original}); spec != nil {
+			for _, c := range podContainers(spec) {
+				name, _ := c.GetString(kyaml.NameField)
+				before[name], _ = c.GetString("image")
+			}
+		}
+	}
+	for _, c := range podContainers(spec) {
+		name, _ := c.GetString(kyaml.NameField)
+		image, _ := c.GetString("image")
+		if image == "" || image == before[name] {
+			continue
+		}
+		registry, qualified := qualifyImage(image)
+		if !slices.ContainsFunc(p.AllowedRegistries, func(allowed string) bool {
+			if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+				return strings.HasPrefix(qualified, prefix)
+			}
+			return allowed == registry
+		}) {
+			return fmt.Errorf(
+				"%s %s has container %s use image %q after applying patch %s, "+
+					"but only images from %s are allowed",
+				res.GetKind(), res.GetName(), name, image, p.patchSource,
+				strings.Join(p.AllowedRegistries, ", "))
+		}
+	}
+	return nil
+}
+
+// qualifyImage returns the registry of the image, and its name,
+// without tag or digest, qualified by the registry.
+func qualifyImage(image string) (registry, qualified string) {
+	name, _, _ := strings.Cut(image, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	first, _, found := strings.Cut(name, "/")
+	switch {
+	case !found:
+		return "docker.io", "docker.io/library/" + name
+	case strings.ContainsAny(first, ".:") || first == "localhost":
+		return first, name
+	default:
+		return "docker.io", "docker.io/" + name
+	}
+}
+
+// validatePatchSize checks that the patch, serialized, is no larger
+// than OversizedPatchRatio times the target it was merged into, as a
+// larger patch is likely a mistaken replacement of the whole resource.
+func (p *PatchTransformerPlugin) validatePatchSize(res *resource.Resource) error {
+	ratio := p.OversizedPatchRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	patchSize := len(p.patchText)
+	if !p.targeted() && len(p.smPatches) > 1 {
+		// each of the untargeted patches merges into a resource of its own
+		for _, patch := range p.smPatches {
+			if patch.OrgId().Equals(res.OrgId()) {
+				patchSize = len(patch.MustString())
+			}
+		}
+	}
+	targetSize := serializedSize(p.originals[res])
+	if float64(patchSize) > ratio*float64(targetSize) {
+		return fmt.Errorf(
+			"patch %s is %d bytes, more than %g times the %d bytes of %s %s it merges into; "+
+				"it may mistakenly replace the whole resource",
+			p.patchSource, patchSize, ratio, targetSize, res.GetKind(), res.GetName())
+	}
+	return nil
+}
+
+// serializedSize returns the length of the node in YAML,
+// leaving out the internal annotations kustomize itself maintains.
+func serializedSize(node *kyaml.RNode) int {
+	if node == nil {
+		return 0
+	}
+	node, err := withoutInternalAnnotations(node)
+	if err != nil {
+		return 0
+	}
+	return len(node.MustString())
+}
+
+// canonicalJSON returns the node in JSON, whose keys are sorted,
+// leaving out the internal annotations kustomize itself maintains.
+func canonicalJSON(node *kyaml.RNode) string {
+	if node.IsNilOrEmpty() {
+		return ""
+	}
+	node, err := withoutInternalAnnotations(node)
+	if err != nil {
+		return ""
+	}
+	doc, _ := node.MarshalJSON()
+	return string(doc)
+}
+
+// withoutInternalAnnotations returns a copy of the node
+// without the internal annotations kustomize itself maintains.
+func withoutInternalAnnotations(node *kyaml.RNode) (*kyaml.RNode, error) {
+	node = node.Copy()
+	for key := range kioutil.GetInternalAnnotations(node) {
+		if err := node.PipeE(kyaml.ClearAnnotation(key)); err != nil {
+			return nil, errors.Wrap(err)
+		}
+	}
+	err := node.PipeE(kyaml.Lookup(kyaml.MetadataField),
+		kyaml.FieldClearer{Name: kyaml.AnnotationsField, IfEmpty: true})
+	return node, errors.Wrap(err)
+}
+
+// referencesAny reports whether any of the references is to one of the
+// given kind/name pairs.
+func referencesAny(refs []configRef, names map[string]bool) bool {
+	for _, ref := range refs {
+		if names[ref.kind+"/"+ref.name] {
+			return true
+		}
+	}
+	return false
+}
+
+// conciseOps are the operations a concise JSON 6902 patch may hold.
+var conciseOps = []string{"add", "remove", "replace", "move", "copy", "test"} //nolint:gochecknoglobals
+
+// environmentSection returns the text of the patch, in the map of the
+// patches per environment that the text holds, for the environment.
+func environmentSection(text, environment string) (string, error) {
+	sections, err := kyaml.Parse(text)
+	if err != nil {
+		return "", errors.WrapPrefixf(err, "parsing the patches per environment")
+	}
+	if sections.YNode().Kind != kyaml.MappingNode {
+		return "", fmt.Errorf("expected a map of patches per environment, for environment %q", environment)
+	}
+	section := sections.Field(environment)
+	if section == nil {
+		names, _ := sections.Fields()
+		return "", fmt.Errorf(
+			"no section for environment %q; expected one of %s", environment, strings.Join(names, ", "))
+	}
+	if node := section.Value.YNode(); node.Kind == kyaml.ScalarNode {
+		return strings.TrimSpace(node.Value), nil
+	}
+	return section.Value.String()
+}
+
+// expandConciseOps returns, as JSON, the JSON 6902 patch that the text
+// gives in concise form, or "" if it isn't in that form: a map holding
+// only ops, a list whose elements each map "<op> <path>" to the value,
+// or for move and copy to the path moved or copied from, e.g.
+//
+//	ops:
+//	- replace /spec/replicas: 3
+//	- remove /metadata/labels/tier:
+//	- move /spec/template/metadata/labels/app: /metadata/labels/app
+func expandConciseOps(text string) (string, error) {
+	// text that doesn't parse is left for the SM and JSON parses to report
+	node, _ := kyaml.Parse(text)
+	if node == nil || node.YNode().Kind != kyaml.MappingNode {
+		return "", nil
+	}
+	fields, _ := node.Fields()
+	if len(fields) != 1 || fields[0] != "ops" {
+		return "", nil
+	}
+	list := node.Field("ops").Value
+	if list.YNode().Kind != kyaml.SequenceNode {
+		return "", fmt.Errorf("ops must be a list")
+	}
+	var ops []map[string]interface{}
+	for i, element := range list.YNode().Content {
+		if element.Kind != kyaml.MappingNode || len(element.Content) != 2 {
+			return "", fmt.Errorf("op %d must map \"<op> <path>\" to a value", i)
+		}
+		words := strings.Fields(element.Content[0].Value)
+		if len(words) != 2 || !slices.Contains(conciseOps, words[0]) || !strings.HasPrefix(words[1], "/") {
+			return "", fmt.Errorf("op %d, %q, isn't an op, one of %s, and a path starting with /",
+				i, element.Content[0].Value, strings.Join(conciseOps, ", "))
+		}
+		op := map[string]interface{}{"op": words[0], "path": words[1]}
+		value := element.Content[1]
+		switch words[0] {
+		case "remove":
+			if value.ShortTag() != kyaml.NodeTagNull {
+				return "", fmt.Errorf("op %d removes %s, so can't have a value", i, words[1])
+			}
+		case "move", "copy":
+			if value.Kind != kyaml.ScalarNode || !strings.HasPrefix(value.Value, "/") {
+				return "", fmt.Errorf("op %d must give the path to %s from", i, words[0])
+			}
+			op["from"] = value.Value
+		default:
+			var v interface{}
+			if err := value.Decode(&v); err != nil {
+				return "", errors.WrapPrefixf(err, "decoding the value of op %d", i)
+			}
+			op["value"] = v
+		}
+		ops = append(ops, op)
+	}
+	expanded, err := json.Marshal(ops)
+	return string(expanded), errors.Wrap(err)
+}
+
 // jsonPatchFromBytes loads a Json 6902 patch from a bytes input
 func jsonPatchFromBytes(in []byte) (jsonpatch.Patch, error) {
 	ops := string(in)
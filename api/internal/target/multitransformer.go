@@ -4,6 +4,8 @@
 package target
 
 import (
+	"sort"
+
 	"sigs.k8s.io/kustomize/api/resmap"
 )
 
@@ -14,15 +16,32 @@ type multiTransformer struct {
 
 var _ resmap.Transformer = &multiTransformer{}
 
-// newMultiTransformer constructs a multiTransformer.
+// newMultiTransformer constructs a multiTransformer, stably ordering
+// the transformers by ascending priority.
 func newMultiTransformer(t []*resmap.TransformerWithProperties) resmap.Transformer {
 	r := &multiTransformer{
 		transformers: make([]*resmap.TransformerWithProperties, len(t)),
 	}
 	copy(r.transformers, t)
+	sort.SliceStable(r.transformers, func(i, j int) bool {
+		return priority(r.transformers[i]) < priority(r.transformers[j])
+	})
 	return r
 }
 
+// priority returns the priority of the transformer, 0 if it has none,
+// looking through the properties the plugin loader may wrap it in.
+func priority(t *resmap.TransformerWithProperties) int {
+	switch tr := t.Transformer.(type) {
+	case resmap.PrioritizedTransformer:
+		return tr.TransformerPriority()
+	case *resmap.TransformerWithProperties:
+		return priority(tr)
+	default:
+		return 0
+	}
+}
+
 // Transform applies the member transformers in order to the resources,
 // optionally detecting and erroring on commutation conflict.
 func (o *multiTransformer) Transform(m resmap.ResMap) error {
@@ -77,3 +77,51 @@ metadata:
 	m := th.Run(".", th.MakeDefaultOptions())
 	th.AssertActualEqualsExpected(m, expected)
 }
+
+func TestInlineTransformerPriority(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	th.WriteF("resource.yaml", `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: whatever
+spec:
+  replicas: 1
+`)
+	th.WriteK(".", `
+resources:
+- resource.yaml
+transformers:
+- |-
+  apiVersion: builtin
+  kind: PatchTransformer
+  metadata:
+    name: high
+  priority: 10
+  patch: '[{"op": "replace", "path": "/spec/replicas", "value": 3}]'
+  target:
+    kind: Deployment
+- |-
+  apiVersion: builtin
+  kind: PatchTransformer
+  metadata:
+    name: low
+  patch: '[{"op": "replace", "path": "/spec/replicas", "value": 2}]'
+  target:
+    kind: Deployment
+`)
+
+	expected := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: whatever
+spec:
+  replicas: 3
+`
+
+	m := th.Run(".", th.MakeDefaultOptions())
+	th.AssertActualEqualsExpected(m, expected)
+}
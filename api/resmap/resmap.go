@@ -21,6 +21,14 @@ type Transformer interface {
 	Transform(m ResMap) error
 }
 
+// A PrioritizedTransformer is a Transformer that asks to be run
+// after the transformers of lower priority in the same list.
+// Transformers that don't implement it have priority 0.
+type PrioritizedTransformer interface {
+	Transformer
+	TransformerPriority() int
+}
+
 // A TransformerWithProperties contains a Transformer and stores
 // some of its properties
 type TransformerWithProperties struct {
@@ -134,6 +134,13 @@ func (th *HarnessEnhanced) PrepExecPlugin(g, v, k string) *HarnessEnhanced {
 	return th
 }
 
+// MakePluginHelpers returns the helpers that the harness hands to
+// plugins it loads, so that tests may configure a plugin directly.
+func (th *HarnessEnhanced) MakePluginHelpers() *resmap.PluginHelpers {
+	return resmap.NewPluginHelpers(
+		th.ldr, valtest_test.MakeFakeValidator(), th.rf, th.pl.Config())
+}
+
 // ResetLoaderRoot interprets its argument as an absolute directory path.
 // It creates the directory, and creates the harness's file loader
 // rooted in that directory.
@@ -167,6 +167,9 @@ func (w *writer) filter(in string) string {
 	if ok, newer := w.replace(in, "*plugin)"); ok {
 		return newer
 	}
+	if ok, newer := w.replace(in, "[]*plugin"); ok {
+		return newer
+	}
 	return in
 }
 
@@ -4,11 +4,23 @@
 package main_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"slices"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/kustomize/api/ifc"
+	"sigs.k8s.io/kustomize/api/provider"
+	"sigs.k8s.io/kustomize/api/resmap"
 	kusttest_test "sigs.k8s.io/kustomize/api/testutils/kusttest"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/openapi"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+	patchtransformer "sigs.k8s.io/kustomize/plugin/builtin/patchtransformer"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -1108,3 +1120,5910 @@ spec:
         name: test-deployment
 `)
 }
+
+// makeResMap builds a ResMap for tests that drive the plugin directly,
+// rather than through the harness, to inspect the plugin's state.
+func makeResMap(t *testing.T, th *kusttest_test.HarnessEnhanced, input string) resmap.ResMap {
+	t.Helper()
+	m, err := th.MakePluginHelpers().ResmapFactory().NewResMapFromBytes([]byte(input))
+	require.NoError(t, err)
+	return m
+}
+
+func TestPatchTransformerRequireCapabilities(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	config := []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+requireCapabilities:
+- apps/v1/Deployment
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+  spec:
+    replica: 3
+`)
+	for name, tc := range map[string]struct {
+		capabilities []string
+		replica      int
+		note         string
+		err          string
+	}{
+		// the patch applies
+		"present": {
+			capabilities: []string{"v1/ConfigMap", "apps/v1/Deployment"},
+			replica:      3,
+		},
+		// the patch is skipped with a note
+		"absent": {
+			capabilities: []string{"v1/ConfigMap"},
+			replica:      1,
+			note:         "cluster lacks required capabilities apps/v1/Deployment",
+		},
+		// the cluster's capabilities aren't known
+		"unset": {
+			err: "requires capabilities apps/v1/Deployment, " +
+				"but the cluster's weren't set with SetCapabilities",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := patchtransformer.KustomizePlugin
+			require.NoError(t, p.Config(th.MakePluginHelpers(), config))
+			if tc.capabilities != nil {
+				p.SetCapabilities(tc.capabilities)
+			}
+			m := makeResMap(t, th, oneDeployment)
+			if tc.err != "" {
+				require.ErrorContains(t, p.Transform(m), tc.err)
+				return
+			}
+			require.NoError(t, p.Transform(m))
+			th.AssertActualEqualsExpectedNoIdAnnotations(m, fmt.Sprintf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: oneDeploy
+spec:
+  replica: %d
+  template:
+    spec:
+      containers:
+      - image: nginx:1.7.9
+        name: nginx
+      - image: busybox:1.36.1
+        name: sidecar
+`, tc.replica))
+			if tc.note == "" {
+				require.Empty(t, p.Notes())
+				return
+			}
+			require.Len(t, p.Notes(), 1)
+			require.Contains(t, p.Notes()[0], tc.note)
+		})
+	}
+}
+
+func TestPatchTransformerSetElementOrder(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: myDeploy
+  spec:
+    template:
+      spec:
+        containers:
+        - name: nginx
+          $setElementOrder/env:
+          - name: C
+          - name: A
+          - name: B
+          env:
+          - name: C
+            value: c
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myDeploy
+spec:
+  template:
+    spec:
+      containers:
+      - name: nginx
+        image: nginx
+        env:
+        - name: A
+          value: a
+        - name: B
+          value: b
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myDeploy
+spec:
+  template:
+    spec:
+      containers:
+      - env:
+        - name: C
+          value: c
+        - name: A
+          value: a
+        - name: B
+          value: b
+        image: nginx
+        name: nginx
+`)
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: notImportantHere
+  spec:
+    template:
+      spec:
+        containers:
+        - name: nginx
+          $setElementOrder/env:
+          - name: B
+          - name: C
+          - name: A
+          env:
+          - name: C
+            value: c
+target:
+  kind: Deployment
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myDeploy
+spec:
+  template:
+    spec:
+      containers:
+      - name: nginx
+        image: nginx
+        env:
+        - name: A
+          value: a
+        - name: B
+          value: b
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myDeploy
+spec:
+  template:
+    spec:
+      containers:
+      - env:
+        - name: B
+          value: b
+        - name: C
+          value: c
+        - name: A
+          value: a
+        image: nginx
+        name: nginx
+`)
+}
+
+func TestPatchTransformerReportFieldConflicts(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: notImportantHere
+  spec:
+    template:
+      spec:
+        containers:
+        - name: nginx
+          image: nginx:latest
+        - name: sidecar
+          image: busybox:1.36.1
+target:
+  name: oneDeploy
+options:
+  reportFieldConflicts: true
+`)))
+	m := makeResMap(t, th, oneDeployment)
+	require.NoError(t, p.Transform(m))
+	th.AssertActualEqualsExpectedNoIdAnnotations(m, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: oneDeploy
+spec:
+  replica: 1
+  template:
+    spec:
+      containers:
+      - image: nginx:latest
+        name: nginx
+      - image: busybox:1.36.1
+        name: sidecar
+`)
+	require.Equal(t, map[string][]patchtransformer.Conflict{
+		"Deployment.v1.apps/oneDeploy.[noNs]": {{
+			Path:        "spec.template.spec.containers[name=nginx].image",
+			TargetValue: "nginx:1.7.9",
+			PatchValue:  "nginx:latest",
+		}},
+	}, p.FieldConflicts())
+}
+
+// sliceOf collects its arguments, letting tests build slices
+// of the plugin's unexported type.
+func sliceOf[T any](items ...T) []T {
+	return items
+}
+
+func TestPatchTransformerApplyToAll(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	replicas := patchtransformer.KustomizePlugin
+	require.NoError(t, replicas.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: '[{"op": "add", "path": "/spec/replicas", "value": 3}]'
+target:
+  kind: Deployment
+`)))
+	label := patchtransformer.KustomizePlugin
+	require.NoError(t, label.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: yourDeploy
+    labels:
+      patched: "true"
+`)))
+
+	first := makeResMap(t, th, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myDeploy
+spec:
+  replicas: 1
+`)
+	second := makeResMap(t, th, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: yourDeploy
+spec:
+  replicas: 1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: yourService
+`)
+	require.NoError(t, patchtransformer.ApplyToAll(
+		sliceOf(&replicas, &label), []resmap.ResMap{first, second}))
+	th.AssertActualEqualsExpectedNoIdAnnotations(first, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myDeploy
+spec:
+  replicas: 3
+`)
+	th.AssertActualEqualsExpectedNoIdAnnotations(second, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    patched: "true"
+  name: yourDeploy
+spec:
+  replicas: 3
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: yourService
+`)
+}
+
+const configRefResources = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  key: value
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app
+        envFrom:
+        - configMapRef:
+            name: app-config
+`
+
+func TestPatchTransformerValidateConfigRefs(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckError(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: '[{"op": "replace", "path": "/metadata/name", "value": "renamed-config"}]'
+target:
+  kind: ConfigMap
+  name: app-config
+options:
+  validateConfigRefs: true
+`, configRefResources, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			`Deployment app references ConfigMap "app-config", which isn't among the resources`)
+	})
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: '[{"op": "add", "path": "/data/other", "value": "value"}]'
+target:
+  kind: ConfigMap
+  name: app-config
+options:
+  validateConfigRefs: true
+`, configRefResources, `
+apiVersion: v1
+data:
+  key: value
+  other: value
+kind: ConfigMap
+metadata:
+  name: app-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - envFrom:
+        - configMapRef:
+            name: app-config
+        image: app
+        name: app
+`)
+}
+
+func TestPatchTransformerCoerceTypes(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: myDeploy
+  spec:
+    template:
+      spec:
+        containers:
+        - name: nginx
+          ports:
+          - containerPort: "8080"
+          env:
+          - name: WORKERS
+            value: 3
+coerceTypes:
+  spec/template/spec/containers/ports/containerPort: int
+  spec/template/spec/containers/env/value: string
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myDeploy
+spec:
+  template:
+    spec:
+      containers:
+      - name: nginx
+        image: nginx
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myDeploy
+spec:
+  template:
+    spec:
+      containers:
+      - env:
+        - name: WORKERS
+          value: "3"
+        image: nginx
+        name: nginx
+        ports:
+        - containerPort: 8080
+`)
+
+	th.RunTransformerAndCheckError(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: myDeploy
+coerceTypes:
+  spec/replicas: float
+`, someDeploymentResources, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err, `unsupported type "float" to coerce field "spec/replicas" to`)
+	})
+}
+
+func TestPatchTransformerRequireSingleContainer(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: yourDeploy
+  spec:
+    template:
+      spec:
+        containers:
+        - name: nginx
+          image: nginx:latest
+options:
+  requireSingleContainer: true
+`, someDeploymentResources, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    old-label: old-value
+  name: myDeploy
+spec:
+  replica: 2
+  template:
+    metadata:
+      labels:
+        old-label: old-value
+    spec:
+      containers:
+      - image: nginx
+        name: nginx
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    new-label: new-value
+  name: yourDeploy
+spec:
+  replica: 1
+  template:
+    metadata:
+      labels:
+        new-label: new-value
+    spec:
+      containers:
+      - image: nginx:latest
+        name: nginx
+---
+apiVersion: apps/v1
+kind: MyKind
+metadata:
+  label:
+    old-label: old-value
+  name: myDeploy
+spec:
+  template:
+    metadata:
+      labels:
+        old-label: old-value
+    spec:
+      containers:
+      - image: nginx
+        name: nginx
+`)
+
+	th.RunTransformerAndCheckError(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: yourDeploy
+  spec:
+    template:
+      spec:
+        containers:
+        - name: sidecar
+          image: busybox
+options:
+  requireSingleContainer: true
+`, someDeploymentResources, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			"Deployment yourDeploy has 2 containers after applying patch")
+	})
+}
+
+func TestPatchTransformerMergeIntoEach(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+mergeIntoEach:
+  listPath: spec/containers
+  patch: |-
+    env:
+    - name: LOG_LEVEL
+      value: debug
+target:
+  kind: Pod
+`, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: pod
+spec:
+  containers:
+  - name: app
+    image: app
+    env:
+    - name: PORT
+      value: "8080"
+  - name: proxy
+    image: proxy
+  - name: logger
+    image: logger
+`, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: pod
+spec:
+  containers:
+  - env:
+    - name: LOG_LEVEL
+      value: debug
+    - name: PORT
+      value: "8080"
+    image: app
+    name: app
+  - env:
+    - name: LOG_LEVEL
+      value: debug
+    image: proxy
+    name: proxy
+  - env:
+    - name: LOG_LEVEL
+      value: debug
+    image: logger
+    name: logger
+`)
+}
+
+func TestPatchTransformerApplyOrder(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: example.com/v1
+  kind: Widget
+  metadata:
+    name: widget
+    namespace: apps
+    labels:
+      patched: "true"
+  ---
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+    namespace: apps
+    labels:
+      patched: "true"
+  ---
+  apiVersion: apiextensions.k8s.io/v1
+  kind: CustomResourceDefinition
+  metadata:
+    name: widgets.example.com
+    labels:
+      patched: "true"
+  ---
+  apiVersion: v1
+  kind: Namespace
+  metadata:
+    name: apps
+    labels:
+      patched: "true"
+`)))
+	m := makeResMap(t, th, `
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: widget
+  namespace: apps
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: apps
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: apps
+`)
+	require.NoError(t, p.Transform(m))
+	order, err := p.ApplyOrder()
+	require.NoError(t, err)
+	var names []string
+	for _, id := range order {
+		names = append(names, id.Kind+"/"+id.Name)
+	}
+	require.Equal(t, []string{
+		"CustomResourceDefinition/widgets.example.com",
+		"Namespace/apps",
+		"Widget/widget",
+		"Deployment/web",
+	}, names)
+}
+
+func TestPatchTransformerPreserveQuoteStyle(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  - op: replace
+    path: /data/greeting
+    value: goodbye
+  - op: replace
+    path: /data/color
+    value: blue
+  - op: replace
+    path: /data/count
+    value: "2"
+target:
+  kind: ConfigMap
+options:
+  preserveQuoteStyle: %t
+`
+	resources := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  greeting: "hello"
+  color: 'red'
+  count: one
+`
+	// A JSON patch loses the styles, which only show when rendering
+	// the RNode, since rendering the ResMap goes through JSON.
+	for option, expected := range map[bool]string{
+		true: `apiVersion: v1
+data:
+  color: 'blue'
+  count: "2"
+  greeting: "goodbye"
+kind: ConfigMap
+metadata:
+  name: config
+`,
+		false: `apiVersion: v1
+data:
+  color: blue
+  count: "2"
+  greeting: goodbye
+kind: ConfigMap
+metadata:
+  name: config
+`,
+	} {
+		m := th.LoadAndRunTransformer(fmt.Sprintf(config, option), resources)
+		m.RemoveBuildAnnotations()
+		require.Equal(t, expected, m.Resources()[0].MustString())
+	}
+}
+
+func TestPatchTransformerRejectReservedAnnotations(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckError(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+    annotations:
+      kubernetes.io/foo: bar
+options:
+  rejectReservedAnnotations: true
+`, oneDeployment, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			`sets annotation "kubernetes.io/foo" on Deployment oneDeploy, but its prefix is reserved by Kubernetes`)
+	})
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+    annotations:
+      kubernetes.io/change-cause: upgrade
+      example.com/owner: team
+allowedReservedAnnotations:
+- kubernetes.io/change-cause
+options:
+  rejectReservedAnnotations: true
+`, oneDeployment, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    example.com/owner: team
+    kubernetes.io/change-cause: upgrade
+  name: oneDeploy
+spec:
+  replica: 1
+  template:
+    spec:
+      containers:
+      - image: nginx:1.7.9
+        name: nginx
+      - image: busybox:1.36.1
+        name: sidecar
+`)
+
+	m := th.LoadAndRunTransformer(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+    annotations:
+      kustomize.config.k8s.io/init-order: init
+  spec:
+    replica: 3
+options:
+  rejectReservedAnnotations: true
+  annotateFieldProvenance: true
+`, oneDeployment)
+	annotations := m.Resources()[0].GetAnnotations()
+	require.Equal(t, "init", annotations["kustomize.config.k8s.io/init-order"])
+	require.Contains(t, annotations["kustomize.config.k8s.io/field-provenance"], `"spec.replica"`)
+}
+
+func TestPatchTransformerPerTargetOptions(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: renamed
+  spec:
+    replica: 3
+target:
+  kind: Deployment
+perTargetOptions:
+- selector:
+    name: myDeploy
+  options:
+    allowNameChange: true
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myDeploy
+spec:
+  replica: 2
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: yourDeploy
+spec:
+  replica: 1
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: renamed
+spec:
+  replica: 3
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: yourDeploy
+spec:
+  replica: 3
+`)
+
+	// the per-target options take precedence over the top-level ones
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: renamed
+target:
+  kind: Deployment
+options:
+  allowNameChange: true
+perTargetOptions:
+- selector:
+    name: yourDeploy
+  options:
+    allowNameChange: false
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myDeploy
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: yourDeploy
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: renamed
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: yourDeploy
+`)
+
+	// the options of the patch as a whole can't be overridden
+	th.RunTransformerAndCheckError(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: '[{"op": "replace", "path": "/spec/replica", "value": 3}]'
+target:
+  kind: Deployment
+perTargetOptions:
+- selector:
+    name: yourDeploy
+  options:
+    validateConfigRefs: true
+`, someDeploymentResources, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			"option validateConfigRefs applies to the patch as a whole, and can't be set in perTargetOptions")
+	})
+}
+
+func TestPatchTransformerChangelogLine(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	for name, tc := range map[string]struct {
+		config   string
+		expected string
+	}{
+		"single resource": {
+			config: `
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: myDeploy
+  spec:
+    replica: 3
+`,
+			expected: "Set spec.replica=3 on Deployment/myDeploy",
+		},
+		// the plugin's own annotations aren't changes of the patch
+		"annotated": {
+			config: `
+syncWave: 2
+options:
+  annotateFieldProvenance: true
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: myDeploy
+    labels:
+      app.kubernetes.io/part-of: shop
+  spec:
+    replica: 3
+`,
+			expected: "Added label app.kubernetes.io/part-of=shop to Deployment/myDeploy; " +
+				"set spec.replica=3 on Deployment/myDeploy",
+		},
+		"several resources": {
+			config: `
+patch: |-
+  - op: add
+    path: /metadata/labels/tier
+    value: frontend
+  - op: replace
+    path: /spec/replica
+    value: 5
+target:
+  kind: Deployment
+`,
+			expected: "Added label tier=frontend to 2 resources; set spec.replica=5 on 2 resources",
+		},
+		"no change": {
+			config: `
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: yourDeploy
+  spec:
+    replica: 1
+`,
+			expected: "",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := patchtransformer.KustomizePlugin
+			require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(tc.config)))
+			require.NoError(t, p.Transform(makeResMap(t, th, someDeploymentResources)))
+			require.Equal(t, tc.expected, p.ChangelogLine())
+		})
+	}
+}
+
+func TestPatchTransformerRejectOversizedPatch(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+  spec:
+    replica: 3
+options:
+  rejectOversizedPatch: true
+`, oneDeployment, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: oneDeploy
+spec:
+  replica: 3
+  template:
+    spec:
+      containers:
+      - image: nginx:1.7.9
+        name: nginx
+      - image: busybox:1.36.1
+        name: sidecar
+`)
+
+	oversizedPatch := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+    labels:
+      app: web
+      tier: frontend
+  spec:
+    replica: 3
+    template:
+      metadata:
+        labels:
+          app: web
+          tier: frontend
+      spec:
+        containers:
+        - name: nginx
+          image: nginx:1.25.3
+          ports:
+          - containerPort: 80
+        - name: sidecar
+          image: busybox:1.36.1
+options:
+  rejectOversizedPatch: true
+`
+	th.RunTransformerAndCheckError(oversizedPatch, oneDeployment, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err, "more than 1 times the")
+		require.ErrorContains(t, err, "bytes of Deployment oneDeploy it merges into")
+	})
+
+	th.RunTransformerAndCheckResult(oversizedPatch+`
+oversizedPatchRatio: 3
+`, oneDeployment, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: web
+    tier: frontend
+  name: oneDeploy
+spec:
+  replica: 3
+  template:
+    metadata:
+      labels:
+        app: web
+        tier: frontend
+    spec:
+      containers:
+      - image: nginx:1.25.3
+        name: nginx
+        ports:
+        - containerPort: 80
+      - image: busybox:1.36.1
+        name: sidecar
+`)
+}
+
+func TestPatchTransformerSyncWave(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  - op: replace
+    path: /spec/replica
+    value: 3
+target:
+  kind: Deployment
+syncWave: -1
+`, someDeploymentResources, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    argocd.argoproj.io/sync-wave: "-1"
+  labels:
+    old-label: old-value
+  name: myDeploy
+spec:
+  replica: 3
+  template:
+    metadata:
+      labels:
+        old-label: old-value
+    spec:
+      containers:
+      - image: nginx
+        name: nginx
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    argocd.argoproj.io/sync-wave: "-1"
+  labels:
+    new-label: new-value
+  name: yourDeploy
+spec:
+  replica: 3
+  template:
+    metadata:
+      labels:
+        new-label: new-value
+    spec:
+      containers:
+      - image: nginx:1.7.9
+        name: nginx
+---
+apiVersion: apps/v1
+kind: MyKind
+metadata:
+  label:
+    old-label: old-value
+  name: myDeploy
+spec:
+  template:
+    metadata:
+      labels:
+        old-label: old-value
+    spec:
+      containers:
+      - image: nginx
+        name: nginx
+`)
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+  spec:
+    replica: 3
+syncWave: 2
+syncWaveAnnotation: example.com/wave
+`, oneDeployment, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    example.com/wave: "2"
+  name: oneDeploy
+spec:
+  replica: 3
+  template:
+    spec:
+      containers:
+      - image: nginx:1.7.9
+        name: nginx
+      - image: busybox:1.36.1
+        name: sidecar
+`)
+}
+
+func TestPatchTransformerPerDocument(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	twoDocuments := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: first
+  annotations:
+    config.kubernetes.io/path: deployments.yaml
+spec:
+  replica: 1
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: second
+  annotations:
+    config.kubernetes.io/path: deployments.yaml
+spec:
+  replica: 1
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: any
+  spec:
+    replica: 3
+target:
+  kind: Deployment
+`
+	patched := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: first
+spec:
+  replica: 3
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: second
+spec:
+  replica: 3
+`
+
+	th.RunTransformerAndCheckResult(config, twoDocuments, patched)
+	th.RunTransformerAndCheckResult(config+`
+options:
+  perDocument: true
+`, twoDocuments, patched)
+	th.RunTransformerAndCheckError(config+`
+options:
+  perDocument: false
+`, twoDocuments, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			`ambiguously matches 2 documents of file "deployments.yaml" `+
+				`(Deployment.v1.apps/first.[noNs], Deployment.v1.apps/second.[noNs])`)
+	})
+
+	// without a path, as under kustomize build, the documents' files
+	// aren't known, and the resources aren't taken to share one
+	th.RunTransformerAndCheckResult(config+`
+options:
+  perDocument: false
+`, strings.ReplaceAll(twoDocuments, "config.kubernetes.io/path", "example.com/path"), `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    example.com/path: deployments.yaml
+  name: first
+spec:
+  replica: 3
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    example.com/path: deployments.yaml
+  name: second
+spec:
+  replica: 3
+`)
+}
+
+func TestPatchTransformerValidateEnvRefs(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	envPatch := func(key string) string {
+		return `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: app
+  spec:
+    template:
+      spec:
+        containers:
+        - name: app
+          env:
+          - name: SETTING
+            valueFrom:
+              configMapKeyRef:
+                name: app-config
+                key: ` + key + `
+options:
+  validateEnvRefs: true
+`
+	}
+
+	th.RunTransformerAndCheckError(envPatch("missing"), configRefResources, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			`Deployment app references key "missing" of ConfigMap "app-config", which has no such key`)
+	})
+
+	th.RunTransformerAndCheckResult(envPatch("key"), configRefResources, `
+apiVersion: v1
+data:
+  key: value
+kind: ConfigMap
+metadata:
+  name: app-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - env:
+        - name: SETTING
+          valueFrom:
+            configMapKeyRef:
+              key: key
+              name: app-config
+        envFrom:
+        - configMapRef:
+            name: app-config
+        image: app
+        name: app
+`)
+}
+
+func TestPatchTransformerTargetChain(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  - op: replace
+    path: /spec/replica
+    value: 3
+targetChain:
+- kind: Deployment
+  name: web
+- kind: Deployment
+  name: yourDeploy
+- kind: Deployment
+`, someDeploymentResources, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    old-label: old-value
+  name: myDeploy
+spec:
+  replica: 2
+  template:
+    metadata:
+      labels:
+        old-label: old-value
+    spec:
+      containers:
+      - image: nginx
+        name: nginx
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    new-label: new-value
+  name: yourDeploy
+spec:
+  replica: 3
+  template:
+    metadata:
+      labels:
+        new-label: new-value
+    spec:
+      containers:
+      - image: nginx:1.7.9
+        name: nginx
+---
+apiVersion: apps/v1
+kind: MyKind
+metadata:
+  label:
+    old-label: old-value
+  name: myDeploy
+spec:
+  template:
+    metadata:
+      labels:
+        old-label: old-value
+    spec:
+      containers:
+      - image: nginx
+        name: nginx
+`)
+
+	th.RunTransformerAndCheckError(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  - op: replace
+    path: /spec/replica
+    value: 3
+target:
+  kind: Deployment
+targetChain:
+- kind: Deployment
+`, someDeploymentResources, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err, "target and targetChain can't be set at the same time")
+	})
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+patch: '[{"op": "add", "path": "/spec/paused", "value": true}]'
+targetChain:
+- name: web0
+- name: yourDeploy
+`)))
+	m := makeResMap(t, th, someDeploymentResources)
+	require.NoError(t, p.Transform(m))
+	require.Nil(t, p.Target)
+	paused, err := m.Select(types.Selector{ResId: resid.ResId{Name: "yourDeploy"}})
+	require.NoError(t, err)
+	require.Contains(t, paused[0].MustString(), "paused: true")
+
+	m = makeResMap(t, th, manyDeployments(1))
+	require.NoError(t, p.Transform(m))
+	require.Contains(t, m.Resources()[0].MustString(), "paused: true")
+}
+
+func TestPatchTransformerSortMapKeys(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  kind: Deployment
+  apiVersion: apps/v1
+  metadata:
+    name: web
+  spec:
+    template:
+      spec:
+        containers:
+        - name: web
+          image: web:2
+options:
+  sortMapKeys: %t
+`
+	resources := `
+kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: web:1
+        args: [--zone, --alpha]
+      - name: sidecar
+        image: sidecar
+`
+	// Rendering the ResMap goes through JSON, which sorts keys anyway,
+	// so the order only shows when rendering the RNode.
+	for option, expected := range map[bool]string{
+		true: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - args: [--zone, --alpha]
+        image: web:2
+        name: web
+      - image: sidecar
+        name: sidecar
+`,
+		false: `kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: web:2
+        args: [--zone, --alpha]
+      - name: sidecar
+        image: sidecar
+`,
+	} {
+		m := th.LoadAndRunTransformer(fmt.Sprintf(config, option), resources)
+		m.RemoveBuildAnnotations()
+		require.Equal(t, expected, m.Resources()[0].MustString())
+	}
+}
+
+func TestPatchTransformerSortMapKeysWithSyncWave(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	// the annotation added after the patch is sorted too
+	m := th.LoadAndRunTransformer(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+syncWave: 2
+patch: |-
+  kind: Deployment
+  apiVersion: apps/v1
+  metadata:
+    name: web
+  spec:
+    replicas: 3
+options:
+  sortMapKeys: true
+`, `
+kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: web
+  annotations:
+    zeta: z
+spec:
+  replicas: 1
+`)
+	// removing the build annotations would reorder metadata
+	annotations, err := m.Resources()[0].Pipe(kyaml.Lookup(kyaml.MetadataField, kyaml.AnnotationsField))
+	require.NoError(t, err)
+	keys, err := annotations.Fields()
+	require.NoError(t, err)
+	require.Contains(t, keys, "argocd.argoproj.io/sync-wave")
+	require.Contains(t, keys, "zeta")
+	require.True(t, slices.IsSorted(keys), "annotations not sorted: %v", keys)
+}
+
+func TestPatchTransformerKeylessMergeAppend(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+  spec:
+    template:
+      spec:
+        containers:
+        - name: web
+          args:
+          - $patch: merge
+          - --verbose
+          - --port=8080
+`
+	resources := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: web
+        args:
+        - --port=8080
+`
+	expected := func(args ...string) string {
+		return `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - args:
+        - ` + strings.Join(args, "\n        - ") + `
+        image: web
+        name: web
+`
+	}
+
+	// by default the list has no merge key, so the patch replaces it,
+	// directive and all
+	th.RunTransformerAndCheckResult(config, resources, expected("$patch: merge", "--verbose", "--port=8080"))
+	th.RunTransformerAndCheckResult(config+`
+options:
+  keylessMergeAppend: true
+`, resources, expected("--port=8080", "--verbose", "--port=8080"))
+	th.RunTransformerAndCheckResult(config+`
+options:
+  keylessMergeAppend: true
+  keylessMergeDedupe: true
+`, resources, expected("--port=8080", "--verbose"))
+}
+
+func TestPatchTransformerRenderApplyCommands(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	for name, tc := range map[string]struct {
+		config   string
+		input    string
+		expected string
+	}{
+		"merge patch": {
+			config: `
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+  spec:
+    replica: 3
+`,
+			input:    oneDeployment,
+			expected: `kubectl patch deployment.apps oneDeploy --type merge -p '{"spec":{"replica":3}}'`,
+		},
+		"renamed": {
+			config: `
+patch: '[{"op": "replace", "path": "/metadata/name", "value": "it''s"}]'
+target:
+  kind: ConfigMap
+`,
+			input: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`,
+			expected: `echo '{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"it'\''s"}}' | kubectl apply -f -`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := patchtransformer.KustomizePlugin
+			require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(tc.config)))
+			require.NoError(t, p.Transform(makeResMap(t, th, tc.input)))
+			require.Equal(t, []string{tc.expected}, p.RenderApplyCommands())
+		})
+	}
+}
+
+// blockingLoader is a loader whose Load blocks until unblocked.
+type blockingLoader struct {
+	ifc.Loader
+	unblock chan struct{}
+}
+
+func (l blockingLoader) Load(string) ([]byte, error) {
+	<-l.unblock
+	return nil, fmt.Errorf("unblocked")
+}
+
+func TestPatchTransformerLoadTimeout(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	h := th.MakePluginHelpers()
+	ldr := blockingLoader{Loader: h.Loader(), unblock: make(chan struct{})}
+	defer close(ldr.unblock)
+	p := patchtransformer.KustomizePlugin
+	err := p.Config(
+		resmap.NewPluginHelpers(ldr, h.Validator(), h.ResmapFactory(), h.GeneralConfig()),
+		[]byte(`
+path: https://example.com/patch.yaml
+loadTimeoutMs: 10
+`))
+	require.ErrorContains(t, err,
+		"failed to get the patch file from path(https://example.com/patch.yaml): timed out after 10ms")
+
+	err = p.Config(h, []byte(`
+path: patch.yaml
+loadTimeoutMs: -1
+`))
+	require.EqualError(t, err, "invalid loadTimeoutMs -1; expected a non-negative number of milliseconds")
+}
+
+func TestPatchTransformerValidatePSS(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	const restricted = `
+pssLevel: restricted
+options:
+  validatePSS: true
+  failOnPSSViolation: true
+`
+	th.LoadAndRunTransformer(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+  spec:
+    template:
+      spec:
+        securityContext:
+          runAsNonRoot: true
+          seccompProfile:
+            type: RuntimeDefault
+        containers:
+        - name: nginx
+          securityContext:
+            allowPrivilegeEscalation: false
+            capabilities:
+              drop: [ALL]
+        - name: sidecar
+          securityContext:
+            allowPrivilegeEscalation: false
+            capabilities:
+              drop: [ALL]
+`+restricted, oneDeployment)
+
+	privileged := `
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+  spec:
+    template:
+      spec:
+        containers:
+        - name: nginx
+          securityContext:
+            privileged: true
+`
+	require.ErrorContains(t, th.ErrorFromLoadAndRunTransformer(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+`+privileged+restricted, oneDeployment),
+		"Deployment oneDeploy violates the restricted Pod Security Standard after applying patch")
+
+	// without failOnPSSViolation the violations are only noted
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(privileged+`
+options:
+  validatePSS: true
+`)))
+	require.NoError(t, p.Transform(makeResMap(t, th, oneDeployment)))
+	require.Len(t, p.Notes(), 1)
+	require.Contains(t, p.Notes()[0], "violates the baseline Pod Security Standard")
+	require.True(t, strings.HasSuffix(p.Notes()[0], ": container nginx is privileged"), p.Notes()[0])
+}
+
+func TestPatchTransformerRequireNamespace(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: '[{"op": "add", "path": "/metadata/labels", "value": {"team": "web"}}]'
+target:
+  namespace: .*
+  name: web
+`
+	resources := `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: web
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web
+  namespace: default
+`
+	th.RunTransformerAndCheckResult(config, resources, `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  labels:
+    team: web
+  name: web
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  labels:
+    team: web
+  name: web
+  namespace: default
+`)
+	th.RunTransformerAndCheckError(config+`
+options:
+  requireNamespace: true
+`, resources, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			`names namespace ".*", but matches ClusterRole web, which has no namespace`)
+	})
+}
+
+func TestPatchTransformerBlastRadius(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+patch: '[{"op": "add", "path": "/data/other", "value": "value"}]'
+target:
+  kind: ConfigMap
+  name: app-config
+`)))
+	require.NoError(t, p.Transform(makeResMap(t, th, configRefResources+`
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+spec:
+  template:
+    spec:
+      containers:
+      - name: db
+        image: db
+      volumes:
+      - name: config
+        configMap:
+          name: app-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: unrelated
+spec:
+  template:
+    spec:
+      containers:
+      - name: unrelated
+        image: unrelated
+`)))
+	report := p.BlastRadius()
+	var direct, indirect []string
+	for _, id := range report.DirectlyModified {
+		direct = append(direct, id.String())
+	}
+	for _, id := range report.IndirectlyAffected {
+		indirect = append(indirect, id.String())
+	}
+	require.Equal(t, []string{"ConfigMap.v1.[noGrp]/app-config.[noNs]"}, direct)
+	require.Equal(t, []string{
+		"Deployment.v1.apps/app.[noNs]",
+		"StatefulSet.v1.apps/db.[noNs]",
+	}, indirect)
+
+	// a second Transform reports on its own ResMap alone
+	require.NoError(t, p.Transform(makeResMap(t, th, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  key: value
+`)))
+	report = p.BlastRadius()
+	require.Len(t, report.DirectlyModified, 1)
+	require.Empty(t, report.IndirectlyAffected)
+}
+
+func TestPatchTransformerMergeConfigMapData(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: config
+  data:
+    $patch: replace
+    c: "3"
+`
+	resources := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  a: "1"
+  b: "2"
+`
+	th.RunTransformerAndCheckResult(config, resources, `
+apiVersion: v1
+data:
+  c: "3"
+kind: ConfigMap
+metadata:
+  name: config
+`)
+	th.RunTransformerAndCheckResult(config+`
+options:
+  mergeConfigMapData: true
+`, resources, `
+apiVersion: v1
+data:
+  a: "1"
+  b: "2"
+  c: "3"
+kind: ConfigMap
+metadata:
+  name: config
+`)
+
+	// the keys the patch deletes stay deleted
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: config
+  data:
+    a: null
+    c: "3"
+options:
+  mergeConfigMapData: true
+`, resources, `
+apiVersion: v1
+data:
+  b: "2"
+  c: "3"
+kind: ConfigMap
+metadata:
+  name: config
+`)
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: ConfigMap
+patch: '[{"op": "remove", "path": "/data/a"}]'
+options:
+  mergeConfigMapData: true
+`, resources, `
+apiVersion: v1
+data:
+  b: "2"
+kind: ConfigMap
+metadata:
+  name: config
+`)
+}
+
+func TestPatchTransformerAllowedRegistries(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := func(image string) string {
+		return `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+  spec:
+    template:
+      spec:
+        containers:
+        - name: nginx
+          image: ` + image + `
+allowedRegistries:
+- gcr.io/*
+`
+	}
+
+	// the sidecar's image isn't checked, as the patch doesn't change it
+	th.RunTransformerAndCheckResult(config("gcr.io/project/nginx:1.25.3"), oneDeployment, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: oneDeploy
+spec:
+  replica: 1
+  template:
+    spec:
+      containers:
+      - image: gcr.io/project/nginx:1.25.3
+        name: nginx
+      - image: busybox:1.36.1
+        name: sidecar
+`)
+	th.RunTransformerAndCheckError(config("docker.io/evil"), oneDeployment, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			`Deployment oneDeploy has container nginx use image "docker.io/evil" after applying patch`)
+		require.ErrorContains(t, err, "but only images from gcr.io/* are allowed")
+	})
+}
+
+func TestPatchTransformerPreserveCommentsJson6902(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: '[{"op": "replace", "path": "/spec/replicas", "value": 3}]'
+target:
+  kind: Deployment
+options:
+  preserveCommentsJson6902: %t
+`
+	resources := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  # the web frontend
+  name: web
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+      - name: web
+        image: web:1 # pinned for now
+`
+	// Comments only show when rendering the RNode,
+	// since rendering the ResMap goes through JSON.
+	m := th.LoadAndRunTransformer(fmt.Sprintf(config, true), resources)
+	m.RemoveBuildAnnotations()
+	require.Equal(t, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  # the web frontend
+  name: web
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - image: web:1 # pinned for now
+        name: web
+`, m.Resources()[0].MustString())
+
+	m = th.LoadAndRunTransformer(fmt.Sprintf(config, false), resources)
+	m.RemoveBuildAnnotations()
+	require.NotContains(t, m.Resources()[0].MustString(), "#")
+}
+
+func TestPatchTransformerValidateVolumeMounts(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	mountPatch := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+  spec:
+    template:
+      spec:
+        containers:
+        - name: nginx
+          volumeMounts:
+          - name: cache
+            mountPath: /cache
+options:
+  validateVolumeMounts: true
+`
+	th.RunTransformerAndCheckError(mountPatch, oneDeployment, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			`Deployment oneDeploy has container nginx mount volume "cache", which isn't declared`)
+	})
+
+	th.RunTransformerAndCheckResult(strings.Replace(mountPatch, `
+        containers:`, `
+        volumes:
+        - name: cache
+          emptyDir: {}
+        containers:`, 1), oneDeployment, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: oneDeploy
+spec:
+  replica: 1
+  template:
+    spec:
+      containers:
+      - image: nginx:1.7.9
+        name: nginx
+        volumeMounts:
+        - mountPath: /cache
+          name: cache
+      - image: busybox:1.36.1
+        name: sidecar
+      volumes:
+      - emptyDir: {}
+        name: cache
+`)
+}
+
+func TestPatchTransformerSetExpr(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+setExpr: spec.replica=3&metadata.labels.[app.kubernetes.io/tier]=web
+target:
+  name: oneDeploy
+`, oneDeployment, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app.kubernetes.io/tier: web
+  name: oneDeploy
+spec:
+  replica: 3
+  template:
+    spec:
+      containers:
+      - image: nginx:1.7.9
+        name: nginx
+      - image: busybox:1.36.1
+        name: sidecar
+`)
+
+	th.RunTransformerAndCheckError(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+setExpr: spec.replica
+target:
+  name: oneDeploy
+`, oneDeployment, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err, `unable to parse [setExpr: "spec.replica"]: expected field=value, not "spec.replica"`)
+	})
+}
+
+// recordingTracer records the spans started and ended, in order.
+type recordingTracer struct {
+	events *[]string
+}
+
+func (tr recordingTracer) Start(name string) patchtransformer.Span {
+	*tr.events = append(*tr.events, "start "+name)
+	return recordingSpan{tr, name}
+}
+
+type recordingSpan struct {
+	tracer recordingTracer
+	name   string
+}
+
+func (s recordingSpan) End() {
+	*s.tracer.events = append(*s.tracer.events, "end "+s.name)
+}
+
+func TestPatchTransformerSetTracer(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	th.WriteF("patch.yaml", `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: oneDeploy
+spec:
+  replica: 3
+`)
+	var events []string
+	p := patchtransformer.KustomizePlugin
+	p.SetTracer(recordingTracer{&events})
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`path: patch.yaml`)))
+	require.NoError(t, p.Transform(makeResMap(t, th, oneDeployment)))
+	require.Equal(t, []string{
+		"start load", "end load",
+		"start parse", "end parse",
+		"start apply",
+		"start select", "end select",
+		"end apply",
+	}, events)
+
+	// without a tracer, nothing is recorded
+	events = nil
+	p = patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`path: patch.yaml`)))
+	require.NoError(t, p.Transform(makeResMap(t, th, oneDeployment)))
+	require.Empty(t, events)
+}
+
+func TestPatchTransformerSkipIncompatibleTargets(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	resources := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: web:1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+spec:
+  ports:
+  - port: 80
+`
+	for name, patch := range map[string]string{
+		"strategic merge": `
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: any
+  spec:
+    template:
+      spec:
+        containers:
+        - name: web
+          image: web:2
+`,
+		"json6902": `
+  - op: replace
+    path: /spec/template/spec/containers/0/image
+    value: web:2
+`,
+		"json6902 keyed path": `
+  - op: replace
+    path: /spec/template/spec/containers[name=web]/image
+    value: web:2
+`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := patchtransformer.KustomizePlugin
+			require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+patch: |-`+patch+`
+target:
+  labelSelector: app=web
+options:
+  skipIncompatibleTargets: true
+`)))
+			m := makeResMap(t, th, resources)
+			require.NoError(t, p.Transform(m))
+			th.AssertActualEqualsExpectedNoIdAnnotations(m, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: web
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - image: web:2
+        name: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    app: web
+  name: web
+spec:
+  ports:
+  - port: 80
+`)
+			require.Len(t, p.Notes(), 1)
+			require.Contains(t, p.Notes()[0], "skipped Service web, which patch")
+		})
+	}
+}
+
+func TestPatchTransformerMinimizePatch(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	for name, tc := range map[string]struct {
+		patch    string
+		expected string
+	}{
+		"json6902": {
+			patch: `
+  - op: replace
+    path: /spec/replica
+    value: 3
+  - op: replace
+    path: /spec/template/spec/containers/0/image
+    value: nginx:1.7.9
+  - op: replace
+    path: /spec/template/spec/containers[name=sidecar]/image
+    value: busybox:1.36.1
+  - op: add
+    path: /metadata/labels
+    value:
+      app: web
+`,
+			expected: `[{"op":"replace","path":"/spec/replica","value":3},` +
+				`{"op":"add","path":"/metadata/labels","value":{"app":"web"}}]`,
+		},
+		"strategic merge": {
+			patch: `
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+  spec:
+    replica: 3
+    template:
+      spec:
+        containers:
+        - name: nginx
+          image: nginx:1.7.9
+        - name: sidecar
+          image: busybox:1.37.0
+`,
+			expected: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: oneDeploy
+spec:
+  replica: 3
+  template:
+    spec:
+      containers:
+      - name: sidecar
+        image: busybox:1.37.0
+`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := patchtransformer.KustomizePlugin
+			require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+patch: |-`+tc.patch+`
+target:
+  name: oneDeploy
+`)))
+			require.NoError(t, p.Transform(makeResMap(t, th, oneDeployment)))
+			minimized, err := p.MinimizePatch()
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, minimized)
+		})
+	}
+}
+
+func TestPatchTransformerValidateInitOrder(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  annotations:
+    kustomize.config.k8s.io/init-order: setup, migrate
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: setup
+        image: busybox
+      - name: migrate
+        image: migrate
+      containers:
+      - name: web
+        image: nginx
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+options:
+  validateInitOrder: true
+patch: '[%s]'
+`
+	for name, tc := range map[string]struct {
+		op   string
+		note string
+	}{
+		"reordered": {
+			op:   `{"op": "move", "from": "/spec/template/spec/initContainers/1", "path": "/spec/template/spec/initContainers/0"}`,
+			note: `Deployment web runs init container migrate before setup, against the order "setup, migrate"`,
+		},
+		// a patch keeping the declared order isn't noted
+		"in order": {
+			op: `{"op": "replace", "path": "/spec/template/spec/initContainers/1/image", "value": "migrate:v2"}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := patchtransformer.KustomizePlugin
+			require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(fmt.Sprintf(config, tc.op))))
+			require.NoError(t, p.Transform(makeResMap(t, th, input)))
+			if tc.note == "" {
+				require.Empty(t, p.Notes())
+				return
+			}
+			require.Len(t, p.Notes(), 1)
+			require.Contains(t, p.Notes()[0], tc.note)
+		})
+	}
+}
+
+func TestPatchTransformerEmptyTarget(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target: {}
+patch: '[{"op": "add", "path": "/metadata/labels", "value": {"tier": "web"}}]'
+`
+	th.RunTransformerAndCheckError(config, input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			"empty target would match every resource; set option allowMatchAll to allow it")
+	})
+
+	th.RunTransformerAndCheckResult(config+`
+options:
+  allowMatchAll: true
+`, input, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    tier: web
+  name: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    tier: web
+  name: web
+`)
+}
+
+func TestPatchTransformerGenerateKustomizationSnippet(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.WriteF("patch.yaml", `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: whatever
+spec:
+  replicas: 3
+`)
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+path: patch.yaml
+target:
+  kind: Deployment
+  labelSelector: tier=web
+options:
+  allowNameChange: true
+`)))
+	snippet, err := p.GenerateKustomizationSnippet()
+	require.NoError(t, err)
+	require.Equal(t, `patches:
+- patch: |-
+    apiVersion: apps/v1
+    kind: Deployment
+    metadata:
+      name: whatever
+    spec:
+      replicas: 3
+  target:
+    kind: Deployment
+    labelSelector: tier=web
+  options:
+    allowNameChange: true
+`, string(snippet))
+
+	// the entry configures an equivalent plugin
+	var k types.Kustomization
+	require.NoError(t, yaml.Unmarshal(snippet, &k))
+	require.Len(t, k.Patches, 1)
+	entry, err := yaml.Marshal(k.Patches[0])
+	require.NoError(t, err)
+	q := patchtransformer.KustomizePlugin
+	require.NoError(t, q.Config(th.MakePluginHelpers(), append([]byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+`), entry...)))
+	require.Equal(t, p.Target, q.Target)
+	require.Equal(t, p.Options, q.Options)
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    tier: web
+spec:
+  replicas: 1
+`
+	m := makeResMap(t, th, input)
+	require.NoError(t, p.Transform(m))
+	n := makeResMap(t, th, input)
+	require.NoError(t, q.Transform(n))
+	require.NoError(t, m.ErrorIfNotEqualLists(n))
+	yml, err := n.AsYaml()
+	require.NoError(t, err)
+	require.Contains(t, string(yml), "replicas: 3")
+
+	// fields that don't change what the patch does are left out
+	p.LoadTimeoutMs = 1000
+	p.Concurrency = 4
+	_, err = p.GenerateKustomizationSnippet()
+	require.NoError(t, err)
+
+	p.SetExpr = "spec.replicas=3"
+	_, err = p.GenerateKustomizationSnippet()
+	require.ErrorContains(t, err, "a patch by setExpr can't be expressed in a kustomization")
+
+	// fields that change what the patch does have no equivalent in a
+	// patches entry, which would drop them
+	for field, config := range map[string]string{
+		"group":                      "group: apps",
+		"allowedKinds":               "allowedKinds: [Deployment]",
+		"namePattern":                "namePattern: web-.*",
+		"requireOwnerLabel":          "requireOwnerLabel: team",
+		"allowedRegistries":          "allowedRegistries: [gcr.io]",
+		"requireCapabilities":        "requireCapabilities: [apps/v1/Deployment]",
+		"syncWave":                   "syncWave: 0",
+		"syncWaveAnnotation":         "syncWaveAnnotation: example.com/wave",
+		"coerceTypes":                "coerceTypes: {spec/replicas: int}",
+		"applyToPaths":               "applyToPaths: [spec/template, spec/previousTemplate]",
+		"perTargetOptions":           "perTargetOptions: [{selector: {name: web}, options: {allowNameChange: true}}]",
+		"mutuallyExclusive":          "mutuallyExclusive: [[spec/volumes/configMap, spec/volumes/secret]]",
+		"oversizedPatchRatio":        "oversizedPatchRatio: 2",
+		"pssLevel":                   "pssLevel: restricted",
+		"sessionAffinity":            "sessionAffinity: None",
+		"maxResultDepth":             "maxResultDepth: 8",
+		"allowedReservedAnnotations": "allowedReservedAnnotations: [kustomize.config.k8s.io/init-order]",
+		"priority":                   "priority: 1",
+		"environment": `environment: dev
+patch: |-
+  dev:
+    apiVersion: apps/v1
+    kind: Deployment
+    metadata:
+      name: whatever
+    spec:
+      replicas: 3`,
+	} {
+		t.Run(field, func(t *testing.T) {
+			if !strings.Contains(config, "patch:") {
+				config += "\npath: patch.yaml"
+			}
+			r := patchtransformer.KustomizePlugin
+			require.NoError(t, r.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+`+config)))
+			_, err := r.GenerateKustomizationSnippet()
+			require.EqualError(t, err, field+" can't be expressed in a kustomization")
+		})
+	}
+}
+
+func TestPatchTransformerRemoveListItems(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - name: web
+    image: nginx
+  - name: debug
+    image: busybox
+  - name: proxy
+    image: envoy
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Pod
+removeListItems:
+  path: spec/containers
+  match:
+    name: debug
+`
+	th.RunTransformerAndCheckResult(config, input, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - image: nginx
+    name: web
+  - image: envoy
+    name: proxy
+`)
+
+	// every field value must match
+	th.RunTransformerAndCheckResult(config+`
+    image: nginx
+`, input, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - image: nginx
+    name: web
+  - image: busybox
+    name: debug
+  - image: envoy
+    name: proxy
+`)
+
+	th.RunTransformerAndCheckError(config+`
+patch: '[{"op": "remove", "path": "/spec/containers/1"}]'
+`, input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err, "removeListItems can't be set along with patch or path")
+	})
+}
+
+func TestPatchTransformerNamePattern(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web-prod
+target:
+  kind: Deployment
+options:
+  allowNameChange: true
+namePattern: '[a-z]+-(dev|prod)'
+`
+	th.RunTransformerAndCheckResult(config, oneDeployment, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web-prod
+spec:
+  replica: 1
+  template:
+    spec:
+      containers:
+      - image: nginx:1.7.9
+        name: nginx
+      - image: busybox:1.36.1
+        name: sidecar
+`)
+
+	th.RunTransformerAndCheckError(strings.Replace(config, "name: web-prod", "name: web-prod-2", 1),
+		oneDeployment, func(t *testing.T, err error) {
+			t.Helper()
+			require.ErrorContains(t, err,
+				`Deployment web-prod-2 doesn't match the name pattern "[a-z]+-(dev|prod)" after applying patch`)
+		})
+}
+
+func TestPatchTransformerStripManagedFields(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: '[{"op": "replace", "path": "/spec/replicas", "value": 3}]'
+target:
+  name: web
+options:
+  stripManagedFields: true
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  managedFields:
+  - manager: kubectl
+    operation: Apply
+    apiVersion: apps/v1
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:spec:
+        f:replicas: {}
+spec:
+  replicas: 1
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  managedFields:
+  - manager: kubectl
+    operation: Apply
+spec:
+  replicas: 1
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  managedFields:
+  - manager: kubectl
+    operation: Apply
+  name: api
+spec:
+  replicas: 1
+`)
+}
+
+func TestPatchTransformerDependencyGraph(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: app
+  spec:
+    template:
+      spec:
+        serviceAccountName: app
+        containers:
+        - name: app
+          envFrom:
+          - configMapRef:
+              name: app-config
+`)))
+	require.NoError(t, p.Transform(makeResMap(t, th, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: app
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app
+`)))
+	graph := p.DependencyGraph()
+	require.Len(t, graph, 1)
+	var deps []string
+	for id, refs := range graph {
+		require.Equal(t, "Deployment.v1.apps/app.[noNs]", id.String())
+		for _, ref := range refs {
+			deps = append(deps, ref.String())
+		}
+	}
+	require.Equal(t, []string{
+		"ConfigMap.v1.[noGrp]/app-config.[noNs]",
+		"ServiceAccount.v1.[noGrp]/app.[noNs]",
+	}, deps)
+}
+
+func TestPatchTransformerFallbackToJsonMerge(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: gadget
+spec:
+  size: 1
+  ports:
+  - 8080
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: example.com/v1
+  kind: Gadget
+  metadata:
+    name: gadget
+  spec:
+    ports:
+      http: 8080
+target:
+  kind: Gadget
+`
+	require.Error(t, th.ErrorFromLoadAndRunTransformer(config, input))
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(config+`
+options:
+  fallbackToJsonMerge: true
+`)))
+	m := makeResMap(t, th, input)
+	require.NoError(t, p.Transform(m))
+	m.RemoveBuildAnnotations()
+	require.Equal(t, `apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: gadget
+spec:
+  ports:
+    http: 8080
+  size: 1
+`, m.Resources()[0].MustString())
+	require.Len(t, p.Notes(), 1)
+	require.Contains(t, p.Notes()[0], "fell back to a JSON merge of patch")
+}
+
+func TestPatchTransformerRequireProbes(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        livenessProbe:
+          httpGet:
+            path: /healthz
+            port: 8080
+        readinessProbe:
+          httpGet:
+            path: /ready
+            port: 8080
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+options:
+  requireProbes: true
+`
+	th.RunTransformerAndCheckResult(config+`
+patch: '[{"op": "replace", "path": "/spec/template/spec/containers/0/image", "value": "nginx:1.27"}]'
+`, input, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - image: nginx:1.27
+        livenessProbe:
+          httpGet:
+            path: /healthz
+            port: 8080
+        name: web
+        readinessProbe:
+          httpGet:
+            path: /ready
+            port: 8080
+`)
+
+	th.RunTransformerAndCheckError(config+`
+patch: '[{"op": "remove", "path": "/spec/template/spec/containers/0/readinessProbe"}]'
+`, input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			"Deployment web has container web without a readinessProbe after applying patch")
+	})
+}
+
+func TestPatchTransformerSeparatorsOnly(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	for _, patch := range []string{"---", "---\n---\n"} {
+		require.ErrorContains(t, th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: %q
+target:
+  kind: Deployment
+`, patch), someDeploymentResources), "holds no patches", patch)
+	}
+}
+
+func TestPatchTransformerDecodedJSONPatch(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+patch: |-
+  - op: replace
+    path: /spec/replicas
+    value: 3
+  - op: remove
+    path: /metadata/labels/tier
+`)))
+	ops, ok := p.DecodedJSONPatch()
+	require.True(t, ok)
+	require.Len(t, ops, 2)
+	require.Equal(t, "replace", ops[0].Kind())
+	path, err := ops[0].Path()
+	require.NoError(t, err)
+	require.Equal(t, "/spec/replicas", path)
+	value, err := ops[0].ValueInterface()
+	require.NoError(t, err)
+	require.InDelta(t, 3, value, 0)
+	require.Equal(t, "remove", ops[1].Kind())
+	path, err = ops[1].Path()
+	require.NoError(t, err)
+	require.Equal(t, "/metadata/labels/tier", path)
+
+	// the ops are a copy
+	*ops[0]["op"] = []byte(`"add"`)
+	ops, _ = p.DecodedJSONPatch()
+	require.Equal(t, "replace", ops[0].Kind())
+
+	p = patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+`)))
+	_, ok = p.DecodedJSONPatch()
+	require.False(t, ok)
+}
+
+func TestPatchTransformerPreserveNumericStyle(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: gadget
+spec:
+  ratio: 0.5
+  threshold: 1.50
+  limit: 1e3
+  weights: [12.0, 0.25]
+  label: "0.50"
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Gadget
+patch: |-
+  [
+    {"op": "replace", "path": "/spec/ratio", "value": 0.10},
+    {"op": "add", "path": "/spec/scale", "value": {"min": 1.0, "max": 2.50}}
+  ]
+`
+	m := th.LoadAndRunTransformer(config, input)
+	m.RemoveBuildAnnotations()
+	require.Contains(t, m.Resources()[0].MustString(), "ratio: 0.1\n")
+
+	m = th.LoadAndRunTransformer(config+`
+options:
+  preserveNumericStyle: true
+`, input)
+	m.RemoveBuildAnnotations()
+	require.Equal(t, `apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: gadget
+spec:
+  label: "0.50"
+  limit: 1e3
+  ratio: 0.10
+  scale:
+    max: 2.50
+    min: 1.0
+  threshold: 1.50
+  weights:
+  - 12.0
+  - 0.25
+`, m.Resources()[0].MustString())
+
+	// a test passes or fails as it would without preserveNumericStyle
+	tested := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Gadget
+patch: |-
+  [
+    {"op": "test", "path": "/spec/threshold", "value": 1.5},
+    {"op": "test", "path": "/spec/weights", "value": [12, 0.25]},
+    {"op": "replace", "path": "/spec/ratio", "value": 0.10}
+  ]
+`
+	m = th.LoadAndRunTransformer(tested, input)
+	require.Contains(t, m.Resources()[0].MustString(), "ratio: 0.1\n")
+	m = th.LoadAndRunTransformer(tested+`
+options:
+  preserveNumericStyle: true
+`, input)
+	require.Contains(t, m.Resources()[0].MustString(), "ratio: 0.10\n")
+	require.Contains(t, m.Resources()[0].MustString(), "threshold: 1.50\n")
+
+	m, err := th.RunTransformer(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Gadget
+patch: '[{"op": "test", "path": "/spec/ratio", "value": 0.7}]'
+options:
+  preserveNumericStyle: true
+`, input)
+	require.Error(t, err)
+	for _, res := range m.Resources() {
+		if !res.IsNilOrEmpty() {
+			require.NotContains(t, res.MustString(), "kustomize.config.k8s.io/number:")
+		}
+	}
+}
+
+func TestPatchTransformerValidateSelectorMatch(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+options:
+  validateSelectorMatch: true
+`
+	th.RunTransformerAndCheckResult(config+`
+patch: '[{"op": "add", "path": "/spec/template/metadata/labels/tier", "value": "frontend"}]'
+`, input, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+        tier: frontend
+`)
+
+	th.RunTransformerAndCheckError(config+`
+patch: '[{"op": "replace", "path": "/spec/template/metadata/labels/app", "value": "api"}]'
+`, input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			"Deployment web selects pods by label app=web, which its pod template doesn't have, after applying patch")
+	})
+}
+
+func TestPatchTransformerAllowedKinds(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+`
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  labelSelector: app=web
+patch: '[{"op": "add", "path": "/metadata/labels/tier", "value": "frontend"}]'
+allowedKinds:
+- Deployment
+`)))
+	m := makeResMap(t, th, input)
+	require.NoError(t, p.Transform(m))
+	m.RemoveBuildAnnotations()
+	yml, err := m.AsYaml()
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: web
+    tier: frontend
+  name: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    app: web
+  name: web
+`, string(yml))
+	require.Len(t, p.Notes(), 1)
+	require.Contains(t, p.Notes()[0], "skipped Service web, as patch")
+}
+
+func TestPatchTransformerRenderModifiedJSON(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: whatever
+  spec:
+    replicas: 3
+    paused: false
+    revisionHistoryLimit: 10
+`)))
+	require.NoError(t, p.Transform(makeResMap(t, th, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  annotations:
+    version: "1.10"
+spec:
+  replicas: 1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+`)))
+	out, err := p.RenderModifiedJSON()
+	require.NoError(t, err)
+	require.True(t, json.Valid(out), string(out))
+	require.JSONEq(t, `[{
+  "apiVersion": "apps/v1",
+  "kind": "Deployment",
+  "metadata": {"name": "web", "annotations": {"version": "1.10"}},
+  "spec": {"replicas": 3, "paused": false, "revisionHistoryLimit": 10}
+}]`, string(out))
+
+	p = patchtransformer.KustomizePlugin
+	out, err = p.RenderModifiedJSON()
+	require.NoError(t, err)
+	require.Equal(t, "[]", string(out))
+}
+
+func TestPatchTransformerRedactPatchSourceInErrors(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: '[{"op": "add", "path": "/stringData/password", "value": "hunter2"}]'
+`
+	redacted := `
+options:
+  redactPatchSourceInErrors: true
+`
+	require.ErrorContains(t, th.ErrorFromLoadAndRunTransformer(config, oneDeployment), "hunter2")
+
+	err := th.ErrorFromLoadAndRunTransformer(config+redacted, oneDeployment)
+	require.ErrorContains(t, err, "must specify a target for JSON patch [patch: sha256:")
+	require.NotContains(t, err.Error(), "hunter2")
+
+	// nor is the patch dumped along with the config
+	err = th.ErrorFromLoadAndRunTransformer(config+redacted+`
+path: patch.yaml
+`, oneDeployment)
+	require.ErrorContains(t, err, "patch and path can't be set at the same time")
+	require.NotContains(t, err.Error(), "hunter2")
+
+	// the path form is kept
+	th.WriteF("patch.json", `[{"op": "add", "path": "/stringData/password", "value": "hunter2"}]`)
+	require.ErrorContains(t, th.ErrorFromLoadAndRunTransformer(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+path: patch.json
+`+redacted, oneDeployment),
+		`must specify a target for JSON patch [path: "patch.json"]`)
+}
+
+func TestPatchTransformerValidateAgainstCRD(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: gadgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Gadget
+    plural: gadgets
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            required: [size]
+            properties:
+              size:
+                type: integer
+              colour:
+                type: string
+                enum: [red, blue]
+              labels:
+                type: object
+                additionalProperties:
+                  type: string
+---
+apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: gadget
+spec:
+  size: 1
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Gadget
+options:
+  validateAgainstCRD: true
+`
+	th.RunTransformerAndCheckResult(config+`
+patch: '[{"op": "add", "path": "/spec/colour", "value": "red"}, {"op": "add", "path": "/spec/labels", "value": {"tier": "web"}}]'
+`, input, `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: gadgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Gadget
+    plural: gadgets
+  scope: Namespaced
+  versions:
+  - name: v1
+    schema:
+      openAPIV3Schema:
+        properties:
+          spec:
+            properties:
+              colour:
+                enum:
+                - red
+                - blue
+                type: string
+              labels:
+                additionalProperties:
+                  type: string
+                type: object
+              size:
+                type: integer
+            required:
+            - size
+            type: object
+        type: object
+    served: true
+    storage: true
+---
+apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: gadget
+spec:
+  colour: red
+  labels:
+    tier: web
+  size: 1
+`)
+
+	th.RunTransformerAndCheckError(config+`
+patch: '[{"op": "add", "path": "/spec/flavour", "value": "mint"}, {"op": "add", "path": "/spec/colour", "value": "green"}]'
+`, input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			"Gadget gadget doesn't conform to CustomResourceDefinition gadgets.example.com after applying patch")
+		require.ErrorContains(t, err,
+			": spec.colour must be one of red, blue; spec.flavour is not declared by the schema")
+	})
+
+	th.RunTransformerAndCheckError(config+`
+patch: '[{"op": "replace", "path": "/spec", "value": {"size": "big"}}]'
+`, input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err, ": spec.size must be of type integer")
+	})
+}
+
+func TestPatchTransformerReplaceProbeBlocks(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        livenessProbe:
+          httpGet:
+            path: /healthz
+            port: 8080
+          initialDelaySeconds: 10
+        readinessProbe:
+          tcpSocket:
+            port: 8080
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+  spec:
+    template:
+      spec:
+        containers:
+        - name: web
+          livenessProbe:
+            exec:
+              command: [cat, /tmp/healthy]
+`
+	// by default, the probe is merged into, mixing the old and the new
+	th.RunTransformerAndCheckResult(config, input, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - image: nginx
+        livenessProbe:
+          exec:
+            command:
+            - cat
+            - /tmp/healthy
+          httpGet:
+            path: /healthz
+            port: 8080
+          initialDelaySeconds: 10
+        name: web
+        readinessProbe:
+          tcpSocket:
+            port: 8080
+`)
+
+	th.RunTransformerAndCheckResult(config+`
+options:
+  replaceProbeBlocks: true
+`, input, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - image: nginx
+        livenessProbe:
+          exec:
+            command:
+            - cat
+            - /tmp/healthy
+        name: web
+        readinessProbe:
+          tcpSocket:
+            port: 8080
+`)
+}
+
+func TestPatchTransformerBytesChanged(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  replicas: "1"
+  motd: hello
+`
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: ConfigMap
+patch: '[{"op": "replace", "path": "/data/replicas", "value": "3"}]'
+`)))
+	require.Zero(t, p.BytesChanged())
+	require.NoError(t, p.Transform(makeResMap(t, th, input)))
+	require.Equal(t, 1, p.BytesChanged())
+
+	p = patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: ConfigMap
+patch: '[{"op": "replace", "path": "/data", "value": {"motd": "`+strings.Repeat("x", 500)+`"}}]'
+`)))
+	require.NoError(t, p.Transform(makeResMap(t, th, input)))
+	require.GreaterOrEqual(t, p.BytesChanged(), 500)
+}
+
+func TestPatchTransformerTolerateTemplateTokens(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: {{ .Values.replicas }}
+  template:
+    spec:
+      containers:
+      - name: web
+        image: "nginx:{{ .Values.tag }}"
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+    labels:
+      app: web
+`
+	require.Error(t, th.ErrorFromLoadAndRunTransformer(config, input))
+
+	for _, patch := range []string{config, strings.Replace(config, `patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+    labels:
+      app: web`, `patch: '[{"op": "add", "path": "/metadata/labels", "value": {"app": "web"}}]'`, 1)} {
+		m := th.LoadAndRunTransformer(patch+`
+options:
+  tolerateTemplateTokens: true
+`, input)
+		m.RemoveBuildAnnotations()
+		yml := m.Resources()[0].MustString()
+		require.Contains(t, yml, "app: web")
+		require.Contains(t, yml, "replicas: '{{ .Values.replicas }}'")
+		require.Contains(t, yml, "nginx:{{ .Values.tag }}", yml)
+	}
+}
+
+func TestPatchTransformerMutuallyExclusive(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  volumes:
+  - name: config
+    configMap:
+      name: web-config
+  - name: cache
+    emptyDir: {}
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Pod
+mutuallyExclusive:
+- [spec/volumes/configMap, spec/volumes/secret, spec/volumes/emptyDir]
+`
+	th.RunTransformerAndCheckResult(config+`
+patch: '[{"op": "add", "path": "/spec/volumes/-", "value": {"name": "creds", "secret": {"secretName": "web"}}}]'
+`, input, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  volumes:
+  - configMap:
+      name: web-config
+    name: config
+  - emptyDir: {}
+    name: cache
+  - name: creds
+    secret:
+      secretName: web
+`)
+
+	th.RunTransformerAndCheckError(config+`
+patch: '[{"op": "add", "path": "/spec/volumes/0/secret", "value": {"secretName": "web"}}]'
+`, input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			"Pod web sets spec/volumes/configMap and spec/volumes/secret, of which at most one may be set, after applying patch")
+	})
+}
+
+func TestPatchTransformerTreatUnknownAsMerge(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: metrics.example.com/v1beta1
+kind: NodeMetrics
+metadata:
+  name: node
+spec:
+  window: 30s
+  usage:
+  - cpu
+  - memory
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: metrics.example.com/v1beta1
+  kind: NodeMetrics
+  metadata:
+    name: node
+  spec:
+    window: null
+    usage:
+      cpu: 250m
+`
+	// the strategic merge can't make the list a map
+	th.RunTransformerAndCheckError(config, input, func(t *testing.T, err error) {
+		t.Helper()
+		require.Error(t, err)
+	})
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(config+`
+options:
+  treatUnknownAsMerge: true
+`)))
+	m := makeResMap(t, th, input)
+	require.NoError(t, p.Transform(m))
+	m.RemoveBuildAnnotations()
+	require.Equal(t, `apiVersion: metrics.example.com/v1beta1
+kind: NodeMetrics
+metadata:
+  name: node
+spec:
+  usage:
+    cpu: 250m
+`, m.Resources()[0].MustString())
+	require.Empty(t, p.Notes())
+
+	// known types are still merged strategically
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  apiVersion: v1
+  kind: Pod
+  metadata:
+    name: web
+  spec:
+    containers:
+    - name: web
+      image: nginx:1.27
+options:
+  treatUnknownAsMerge: true
+`, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - name: web
+    image: nginx
+  - name: sidecar
+    image: envoy
+`, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - image: nginx:1.27
+    name: web
+  - image: envoy
+    name: sidecar
+`)
+}
+
+func TestPatchTransformerSkippedResources(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  labelSelector: app=web
+patch: '[{"op": "replace", "path": "/spec/template/metadata/labels/tier", "value": "frontend"}]'
+allowedKinds:
+- Deployment
+- StatefulSet
+options:
+  skipIncompatibleTargets: true
+`)))
+	require.NoError(t, p.Transform(makeResMap(t, th, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: web
+spec:
+  template:
+    metadata:
+      labels:
+        tier: web
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+  labels:
+    app: web
+spec:
+  serviceName: db
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+`)))
+	skipped := make(map[string]string)
+	for id, reason := range p.SkippedResources() {
+		skipped[id.String()] = reason
+	}
+	require.Len(t, skipped, 2)
+	require.Equal(t, "kind not allowed", skipped["Service.v1.[noGrp]/web.[noNs]"])
+	require.True(t, strings.HasPrefix(skipped["StatefulSet.v1.apps/db.[noNs]"], "incompatible target: "),
+		skipped["StatefulSet.v1.apps/db.[noNs]"])
+}
+
+func TestPatchTransformerConciseOps(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: web
+    tier: frontend
+spec:
+  replicas: 1
+  selector: {}
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+patch: |-
+  ops:
+`
+	th.RunTransformerAndCheckResult(config+`
+  - replace /spec/replicas: 3
+  - remove /metadata/labels/tier:
+  - copy /spec/selector/matchLabels: /metadata/labels
+  - add /metadata/annotations: {owner: team-a}
+`, input, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    owner: team-a
+  labels:
+    app: web
+  name: web
+spec:
+  replicas: 3
+  selector:
+    matchLabels:
+      app: web
+`)
+
+	for ops, message := range map[string]string{
+		"  - rename /spec/replicas: 3\n":        `op 0, "rename /spec/replicas", isn't an op`,
+		"  - replace spec/replicas: 3\n":        `op 0, "replace spec/replicas", isn't an op`,
+		"  - remove /metadata/labels/tier: x\n": "op 0 removes /metadata/labels/tier, so can't have a value",
+		"  - move /spec/paused: {}\n":           "op 0 must give the path to move from",
+		"  - replace /spec/replicas\n":          `op 0 must map "<op> <path>" to a value`,
+	} {
+		err := th.ErrorFromLoadAndRunTransformer(config+ops, input)
+		require.ErrorContains(t, err, "invalid ops in [patch: ", ops)
+		require.ErrorContains(t, err, message, ops)
+	}
+}
+
+func TestPatchTransformerRequireRollingUpdate(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+  strategy:
+    type: RollingUpdate
+    rollingUpdate:
+      maxSurge: 1
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+options:
+  requireRollingUpdate: true
+`
+	th.RunTransformerAndCheckResult(config+`
+patch: '[{"op": "replace", "path": "/spec/replicas", "value": 3}]'
+`, input, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+  strategy:
+    rollingUpdate:
+      maxSurge: 1
+    type: RollingUpdate
+`)
+
+	th.RunTransformerAndCheckError(config+`
+patch: '[{"op": "replace", "path": "/spec/strategy", "value": {"type": "Recreate"}}]'
+`, input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			"Deployment web has strategy Recreate after applying patch")
+		require.ErrorContains(t, err, "but RollingUpdate is required")
+	})
+}
+
+func TestPatchTransformerValidateAnnotationSize(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  annotations:
+    existing: ` + strings.Repeat("x", 200*1024) + `
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: ConfigMap
+options:
+  validateAnnotationSize: true
+patch: '[{"op": "add", "path": "/metadata/annotations/added", "value": "%s"}]'
+`
+	th.LoadAndRunTransformer(fmt.Sprintf(config, strings.Repeat("y", 1024)), input)
+	require.ErrorContains(t,
+		th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, strings.Repeat("y", 60*1024)), input),
+		"ConfigMap config has annotations of 266253 bytes after applying patch")
+}
+
+func TestPatchTransformerRenderColorDiff(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+noColor: %t
+patch: '[{"op": "replace", "path": "/spec/template/spec/containers/0/image", "value": "nginx:1.25"}]'
+`
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(fmt.Sprintf(config, false))))
+	require.NoError(t, p.Transform(makeResMap(t, th, oneDeployment)))
+	diff := p.RenderColorDiff()
+	require.Contains(t, diff, "\x1b[31m-      - image: nginx:1.7.9\x1b[0m\n")
+	require.Contains(t, diff, "\x1b[32m+      - image: nginx:1.25\x1b[0m\n")
+
+	p = patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(fmt.Sprintf(config, true))))
+	require.NoError(t, p.Transform(makeResMap(t, th, oneDeployment)))
+	diff = p.RenderColorDiff()
+	require.Equal(t, `--- Deployment/oneDeploy
++++ Deployment/oneDeploy
+@@ -7,7 +7,7 @@
+   template:
+     spec:
+       containers:
+-      - image: nginx:1.7.9
++      - image: nginx:1.25
+         name: nginx
+       - image: busybox:1.36.1
+         name: sidecar
+`, diff)
+}
+
+func TestPatchTransformerTargetsOverlap(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+patch: |-
+  - op: add
+    path: /spec/template/spec/containers/-
+    value:
+      name: sidecar
+      image: busybox
+targets:
+- kind: Deployment
+  name: myDeploy
+- name: myDeploy
+`
+	th.RunTransformerAndCheckResult(config, someDeploymentResources, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    old-label: old-value
+  name: myDeploy
+spec:
+  replica: 2
+  template:
+    metadata:
+      labels:
+        old-label: old-value
+    spec:
+      containers:
+      - image: nginx
+        name: nginx
+      - image: busybox
+        name: sidecar
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    new-label: new-value
+  name: yourDeploy
+spec:
+  replica: 1
+  template:
+    metadata:
+      labels:
+        new-label: new-value
+    spec:
+      containers:
+      - image: nginx:1.7.9
+        name: nginx
+---
+apiVersion: apps/v1
+kind: MyKind
+metadata:
+  label:
+    old-label: old-value
+  name: myDeploy
+spec:
+  template:
+    metadata:
+      labels:
+        old-label: old-value
+    spec:
+      containers:
+      - image: nginx
+        name: nginx
+      - image: busybox
+        name: sidecar
+`)
+
+	th.RunTransformerAndCheckError(config+`
+options:
+  errorOnOverlap: true
+`, someDeploymentResources, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err, "Deployment myDeploy matches both target "+
+			`"Deployment.[noVer].[noGrp]/myDeploy.[noNs]:a=:l=" and target "[noKind].[noVer].[noGrp]/myDeploy.[noNs]:a=:l="`)
+	})
+}
+
+func TestPatchTransformerCheckAgainstResourceQuota(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: v1
+kind: ResourceQuota
+metadata:
+  name: compute
+  namespace: team
+spec:
+  hard:
+    requests.cpu: "1"
+    memory: 1Gi
+    pods: "10"
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: team
+spec:
+  replicas: 2
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        resources:
+          requests:
+            cpu: 250m
+            memory: 256Mi
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+options:
+  checkAgainstResourceQuota: true
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+    namespace: team
+  spec:
+    template:
+      spec:
+        containers:
+        - name: web
+          resources:
+            requests:
+              cpu: %s
+`
+	for cpu, note := range map[string]string{
+		"500m": "",
+		"750m": `brings requests.cpu of the modified workloads in namespace "team" ` +
+			"to 1.5, more than the 1 allowed by ResourceQuota compute",
+	} {
+		t.Run(cpu, func(t *testing.T) {
+			p := patchtransformer.KustomizePlugin
+			require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(fmt.Sprintf(config, cpu))))
+			require.NoError(t, p.Transform(makeResMap(t, th, input)))
+			if note == "" {
+				require.Empty(t, p.Notes())
+				return
+			}
+			require.Len(t, p.Notes(), 1)
+			require.Contains(t, p.Notes()[0], note)
+		})
+	}
+}
+
+func TestPatchTransformerKeyedJsonPointer(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+patch: |-
+  - op: replace
+    path: /spec/template/spec/containers[name=sidecar]/image
+    value: busybox:1.37.0
+  - op: add
+    path: /spec/template/spec/containers[name=nginx]/args
+    value: ["-g", "daemon off;"]
+`, oneDeployment, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: oneDeploy
+spec:
+  replica: 1
+  template:
+    spec:
+      containers:
+      - args:
+        - -g
+        - daemon off;
+        image: nginx:1.7.9
+        name: nginx
+      - image: busybox:1.37.0
+        name: sidecar
+`)
+
+	th.RunTransformerAndCheckError(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+patch: |-
+  - op: remove
+    path: /spec/template/spec/containers[name=app]
+`, oneDeployment, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			"no element of containers has name=app, as path /spec/template/spec/containers[name=app] requires")
+	})
+}
+
+func TestPatchTransformerAnnotateFieldProvenance(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.WriteF("patch.yaml", `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: oneDeploy
+spec:
+  replica: 3
+  template:
+    spec:
+      containers:
+      - name: nginx
+        image: nginx:1.25
+`)
+	m := th.LoadAndRunTransformer(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+path: patch.yaml
+options:
+  annotateFieldProvenance: true
+`, oneDeployment)
+	provenance := make(map[string]string)
+	require.NoError(t, json.Unmarshal(
+		[]byte(m.Resources()[0].GetAnnotations()["kustomize.config.k8s.io/field-provenance"]), &provenance))
+	require.Equal(t, map[string]string{
+		"spec.replica": `[path: "patch.yaml"]`,
+		"spec.template.spec.containers[name=nginx].image": `[path: "patch.yaml"]`,
+	}, provenance)
+
+	labels := make([]string, 25)
+	for i := range labels {
+		labels[i] = fmt.Sprintf("    example.com/label%d: value", i)
+	}
+	m = th.LoadAndRunTransformer(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+syncWave: 2
+options:
+  annotateFieldProvenance: true
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: oneDeploy
+    labels:
+`+strings.ReplaceAll("\n"+strings.Join(labels, "\n"), "\n", "\n  ")[1:]+`
+`, oneDeployment)
+	provenance = make(map[string]string)
+	require.NoError(t, json.Unmarshal(
+		[]byte(m.Resources()[0].GetAnnotations()["kustomize.config.k8s.io/field-provenance"]), &provenance))
+	// the labels, whose keys hold dots, are recorded by their parent,
+	// and the patch given inline by a hash of its text; the sync wave
+	// annotation, which the plugin adds, isn't recorded
+	require.Len(t, provenance, 1)
+	require.Regexp(t, `^\[patch: sha256:[0-9a-f]{12}\]$`, provenance["metadata.labels.*"])
+}
+
+func TestPatchTransformerInitializeNullParents(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+  template: null
+`
+	expected := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+      - image: nginx
+        name: web
+`
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+options:
+  initializeNullParents: true
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+  spec:
+    template:
+      spec:
+        containers:
+        - name: web
+          image: nginx
+`, input, expected)
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+patch: |-
+  - op: add
+    path: /spec/template/spec
+    value:
+      containers:
+      - name: web
+        image: nginx
+`
+	th.RunTransformerAndCheckError(config, input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err, `doc is missing path: "/spec/template/spec"`)
+	})
+	th.RunTransformerAndCheckResult(config+`
+options:
+  initializeNullParents: true
+`, input, expected)
+}
+
+// appsRegistry knows the schemas of the kinds of the apps group.
+type appsRegistry struct{}
+
+func (appsRegistry) Schema(gvk resid.Gvk) *openapi.ResourceSchema {
+	if gvk.Group != "apps" {
+		return nil
+	}
+	return openapi.SchemaForResourceType(kyaml.TypeMeta{APIVersion: gvk.ApiVersion(), Kind: gvk.Kind})
+}
+
+func TestPatchTransformerSetSchemaRegistry(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: %s
+patch: |-
+  kind: Deployment
+  metadata:
+    name: web
+  spec:
+    %s: 3
+`
+	transform := func(kind, field string) (resmap.ResMap, error) {
+		p := patchtransformer.KustomizePlugin
+		p.SetSchemaRegistry(appsRegistry{})
+		require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(fmt.Sprintf(config, kind, field))))
+		m := makeResMap(t, th, input)
+		return m, p.Transform(m)
+	}
+
+	m, err := transform("Deployment", "replicas")
+	require.NoError(t, err)
+	replicas, err := m.Resources()[0].GetFieldValue("spec.replicas")
+	require.NoError(t, err)
+	require.Equal(t, 3, replicas)
+
+	_, err = transform("Deployment", "replcas")
+	require.ErrorContains(t, err,
+		"sets spec.replcas on Deployment web, but the schema of Deployment.v1.apps has no such field")
+
+	_, err = transform("ConfigMap", "replicas")
+	require.ErrorContains(t, err,
+		"targets ConfigMap config, but the schema registry doesn't know ConfigMap.v1.[noGrp]")
+}
+
+func TestPatchTransformerConcurrency(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := manyDeployments(50)
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+concurrency: %d
+patch: '[{"op": "replace", "path": "/spec/replicas", "value": 3}]'
+`
+	transform := func(concurrency int) string {
+		p := patchtransformer.KustomizePlugin
+		require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(fmt.Sprintf(config, concurrency))))
+		m := makeResMap(t, th, input)
+		require.NoError(t, p.Transform(m))
+		require.Len(t, p.Notes(), 0)
+		m.RemoveBuildAnnotations()
+		out, err := m.AsYaml()
+		require.NoError(t, err)
+		return string(out)
+	}
+	serial := transform(1)
+	require.Equal(t, 50, strings.Count(serial, "replicas: 3"))
+	require.Equal(t, serial, transform(8))
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+concurrency: 8
+patch: '[{"op": "test", "path": "/metadata/name", "value": "web7"}]'
+`)))
+	require.ErrorContains(t, p.Transform(makeResMap(t, th, input)), "testing value /metadata/name failed")
+}
+
+// manyDeployments returns n Deployments, named web0 onward.
+func manyDeployments(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web%d
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx
+`, i)
+	}
+	return b.String()
+}
+
+func BenchmarkPatchTransformerConcurrency(b *testing.B) {
+	rmf := resmap.NewFactory(provider.NewDefaultDepProvider().GetResourceFactory())
+	helpers := resmap.NewPluginHelpers(nil, nil, rmf, types.DisabledPluginConfig())
+	input := []byte(manyDeployments(2000))
+	for _, concurrency := range []int{1, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				p := patchtransformer.KustomizePlugin
+				require.NoError(b, p.Config(helpers, []byte(fmt.Sprintf(`
+target:
+  kind: Deployment
+concurrency: %d
+patch: '[{"op": "replace", "path": "/spec/replicas", "value": 3}]'
+`, concurrency))))
+				m, err := rmf.NewResMapFromBytes(input)
+				require.NoError(b, err)
+				b.StartTimer()
+				require.NoError(b, p.Transform(m))
+			}
+		})
+	}
+}
+
+func TestPatchTransformerPreviewLimited(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+patch: '[{"op": "replace", "path": "/spec/replicas", "value": 3}]'
+`)))
+	require.NoError(t, p.Transform(makeResMap(t, th, manyDeployments(5))))
+
+	diffs, truncated := p.PreviewLimited(2)
+	require.True(t, truncated)
+	require.Len(t, diffs, 2)
+	require.Equal(t, "web0", diffs[0].Id.Name)
+	require.Equal(t, "web1", diffs[1].Id.Name)
+	require.Contains(t, diffs[1].Diff, "-  replicas: 1\n+  replicas: 3\n")
+
+	diffs, truncated = p.PreviewLimited(5)
+	require.False(t, truncated)
+	require.Len(t, diffs, 5)
+}
+
+func TestPatchTransformerPreserveEmptyCollections(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+options:
+  preserveEmptyCollections: true
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+  spec:
+    template:
+      spec:
+        containers:
+        - name: web
+          image: nginx:1.25
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    metadata:
+      labels: {}
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        env: []
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    metadata:
+      labels: {}
+    spec:
+      containers:
+      - env: []
+        image: nginx:1.25
+        name: web
+`)
+}
+
+func TestPatchTransformerFixHPARefs(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+  name: web
+options:
+  allowNameChange: true
+  fixHPARefs: true
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: frontend
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+---
+apiVersion: autoscaling/v2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: web
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: web
+  maxReplicas: 5
+---
+apiVersion: autoscaling/v2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: other
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: StatefulSet
+    name: web
+  maxReplicas: 5
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+---
+apiVersion: autoscaling/v2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: web
+spec:
+  maxReplicas: 5
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: frontend
+---
+apiVersion: autoscaling/v2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: other
+spec:
+  maxReplicas: 5
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: StatefulSet
+    name: web
+`)
+}
+
+func TestPatchTransformerApplyToPaths(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Rollout
+applyToPaths:
+- spec/template
+- spec/previousTemplate
+- spec/canaryTemplate
+patch: |-
+  apiVersion: example.com/v1
+  kind: Rollout
+  metadata:
+    name: web
+  spec:
+    template:
+      metadata:
+        labels:
+          tier: frontend
+`, `
+apiVersion: example.com/v1
+kind: Rollout
+metadata:
+  name: web
+spec:
+  template:
+    metadata:
+      labels:
+        app: web
+  previousTemplate:
+    metadata:
+      labels:
+        app: web-old
+`, `
+apiVersion: example.com/v1
+kind: Rollout
+metadata:
+  name: web
+spec:
+  previousTemplate:
+    metadata:
+      labels:
+        app: web-old
+        tier: frontend
+  template:
+    metadata:
+      labels:
+        app: web
+        tier: frontend
+`)
+}
+
+func TestPatchTransformerApplyToPathsInvalid(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t)
+	defer th.Reset()
+
+	for name, tc := range map[string]struct {
+		config string
+		err    string
+	}{
+		"single path": {
+			config: `
+applyToPaths:
+- spec/template
+patch: |-
+  apiVersion: example.com/v1
+  kind: Rollout
+  metadata:
+    name: web
+`,
+			err: "applyToPaths must list at least two paths, the first of which is copied to the others",
+		},
+		"json patch": {
+			config: `
+applyToPaths:
+- spec/template
+- spec/previousTemplate
+patch: '[{"op": "add", "path": "/spec/template/metadata/labels/tier", "value": "frontend"}]'
+`,
+			err: "applyToPaths applies only to strategic merge patches, not to [patch: ",
+		},
+		"mergeIntoEach": {
+			config: `
+applyToPaths:
+- spec/template
+- spec/previousTemplate
+mergeIntoEach:
+  listPath: spec/template/spec/containers
+  patch: '{imagePullPolicy: Always}'
+`,
+			err: "applyToPaths applies only to strategic merge patches",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := patchtransformer.KustomizePlugin
+			err := p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Rollout
+`+tc.config))
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestPatchTransformerExplainSelection(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+  labelSelector: tier=frontend
+patch: '[{"op": "replace", "path": "/spec/replicas", "value": 3}]'
+`)))
+	m := makeResMap(t, th, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    tier: frontend
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  labels:
+    tier: backend
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    tier: frontend
+`)
+	require.Equal(t, map[resid.ResId]string{
+		resid.NewResId(resid.NewGvk("apps", "v1", "Deployment"), "web"): "matched",
+		resid.NewResId(resid.NewGvk("apps", "v1", "Deployment"), "api"): "missed: labels",
+		resid.NewResId(resid.NewGvk("", "v1", "Service"), "web"):        "missed: gvk",
+	}, p.ExplainSelection(m))
+}
+
+func TestPatchTransformerDedupeEnvByName(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        env:
+        - name: LOG_LEVEL
+          value: info
+        - name: PORT
+          value: "8080"
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+patch: '[{"op": "add", "path": "/spec/template/spec/containers/0/env/-", "value": {"name": "LOG_LEVEL", "value": "debug"}}]'
+`
+	th.RunTransformerAndCheckResult(config, input, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - env:
+        - name: LOG_LEVEL
+          value: info
+        - name: PORT
+          value: "8080"
+        - name: LOG_LEVEL
+          value: debug
+        image: nginx
+        name: web
+`)
+	th.RunTransformerAndCheckResult(config+`
+options:
+  dedupeEnvByName: true
+`, input, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - env:
+        - name: PORT
+          value: "8080"
+        - name: LOG_LEVEL
+          value: debug
+        image: nginx
+        name: web
+`)
+}
+
+func TestPatchTransformerRequireSessionAffinity(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+`
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+options:
+  requireSessionAffinity: true
+patch: |-
+  apiVersion: v1
+  kind: Service
+  metadata:
+    name: web
+  spec:
+    %s
+`
+	th.RunTransformerAndCheckResult(fmt.Sprintf(config, "sessionAffinity: ClientIP"), input, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+  sessionAffinity: ClientIP
+`)
+	th.RunTransformerAndCheckError(fmt.Sprintf(config, "type: ClusterIP"), input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err, "Service web has session affinity None after applying patch")
+		require.ErrorContains(t, err, "but ClientIP is required")
+	})
+}
+
+func TestPatchTransformerPreferNewestApiVersion(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: apps/v1beta2
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+---
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+`
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+  name: web
+options:
+  preferNewestApiVersion: true
+patch: '[{"op": "replace", "path": "/spec/replicas", "value": 3}]'
+`)))
+	m := makeResMap(t, th, input)
+	require.NoError(t, p.Transform(m))
+	m.RemoveBuildAnnotations()
+	out, err := m.AsYaml()
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: apps/v1beta2
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+---
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+`, string(out))
+	require.Contains(t, p.Notes(), `skipped Deployment web at apps/v1beta2, as patch `+
+		`[patch: "[{\"op\": \"replace\", \"path\": \"/spec/replicas\", \"value\": 3}]"] also matches it at the newer apps/v1`)
+	require.Contains(t, p.Notes(), `skipped Deployment web at extensions/v1beta1, as patch `+
+		`[patch: "[{\"op\": \"replace\", \"path\": \"/spec/replicas\", \"value\": 3}]"] also matches it at the newer apps/v1`)
+}
+
+func TestPatchTransformerFindings(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+options:
+  validatePSS: true
+  validateVolumeMounts: true
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+  spec:
+    template:
+      spec:
+        containers:
+        - name: web
+          securityContext:
+            privileged: true
+          volumeMounts:
+          - name: data
+            mountPath: /data
+`)))
+	err := p.Transform(makeResMap(t, th, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx
+`))
+	require.Error(t, err)
+
+	id := resid.NewResId(resid.NewGvk("apps", "v1", "Deployment"), "web")
+	findings := p.Findings()
+	require.Len(t, findings, 2)
+	require.Equal(t, patchtransformer.SeverityWarn, findings[0].Severity)
+	require.Equal(t, id, findings[0].ResourceId)
+	require.Equal(t, "validatePSS", findings[0].Rule)
+	require.Contains(t, findings[0].Message, "violates the baseline Pod Security Standard")
+	require.Equal(t, patchtransformer.Finding{
+		Severity:   patchtransformer.SeverityError,
+		ResourceId: id,
+		Rule:       "validateVolumeMounts",
+		Message:    err.Error(),
+	}, findings[1])
+}
+
+func TestPatchTransformerSkipKustomizeMeta(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  name: web
+options:
+  skipKustomizeMeta: true
+patch: '[{"op": "add", "path": "/metadata/labels", "value": {"tier": "frontend"}}]'
+`)))
+	m := makeResMap(t, th, `
+apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+metadata:
+  name: web
+resources:
+- deployment.yaml
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+`)
+	require.NoError(t, p.Transform(m))
+	m.RemoveBuildAnnotations()
+	out, err := m.AsYaml()
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+metadata:
+  name: web
+resources:
+- deployment.yaml
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    tier: frontend
+  name: web
+`, string(out))
+	require.Equal(t, map[resid.ResId]string{
+		resid.NewResId(resid.NewGvk("kustomize.config.k8s.io", "v1beta1", "Kustomization"), "web"): "kustomize metadata",
+	}, p.SkippedResources())
+}
+
+func TestPatchTransformerFieldChangeSummary(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := manyDeployments(3) + `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: scaled
+spec:
+  replicas: 3
+`
+	for name, tc := range map[string]struct {
+		config   string
+		expected map[string]int
+	}{
+		"every deployment": {
+			config: `
+target:
+  kind: Deployment
+patch: |-
+  kind: Deployment
+  metadata:
+    name: any
+    labels:
+      tier: frontend
+`,
+			expected: map[string]int{"metadata.labels.tier": 4},
+		},
+		"some deployments": {
+			config: `
+target:
+  name: web.*
+patch: |-
+  kind: Deployment
+  metadata:
+    name: any
+    labels:
+      tier: frontend
+  spec:
+    replicas: 3
+`,
+			expected: map[string]int{"metadata.labels.tier": 3, "spec.replicas": 3},
+		},
+		"annotated": {
+			config: `
+target:
+  name: scaled
+syncWave: 2
+options:
+  annotateFieldProvenance: true
+patch: |-
+  kind: Deployment
+  metadata:
+    name: any
+    labels:
+      app.kubernetes.io/part-of: shop
+`,
+			expected: map[string]int{"metadata.labels.[app.kubernetes.io/part-of]": 1},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := patchtransformer.KustomizePlugin
+			require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+`+tc.config)))
+			require.NoError(t, p.Transform(makeResMap(t, th, input)))
+			require.Equal(t, tc.expected, p.FieldChangeSummary())
+		})
+	}
+}
+
+func TestPatchTransformerStripLiveFields(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.RunTransformerAndCheckResult(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+options:
+  stripLiveFields: true
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+  spec:
+    replicas: 3
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: default
+  resourceVersion: "123456"
+  uid: 0b7a3e52-4c1d-4f5e-9d9b-2f0f3c7a8e11
+  creationTimestamp: "2024-01-02T03:04:05Z"
+  generation: 4
+spec:
+  replicas: 1
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  generation: 4
+  name: web
+  namespace: default
+spec:
+  replicas: 3
+`)
+}
+
+func TestPatchTransformerMaxResultDepth(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+maxResultDepth: %d
+options:
+  maxResultDepth: true
+patch: |-
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: settings
+  data:
+    a:
+      b:
+        c:
+          d:
+            - e: f
+`
+	input := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+`
+	th.RunTransformerAndCheckError(fmt.Sprintf(config, 5), input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			`ConfigMap settings nests 7 levels deep after applying patch [patch: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\ndata:\n  a:\n    b:\n      c:\n        d:\n          - e: f"], more than the 5 allowed`)
+	})
+	th.RunTransformerAndCheckResult(fmt.Sprintf(config, 7), input, `
+apiVersion: v1
+data:
+  a:
+    b:
+      c:
+        d:
+        - e: f
+kind: ConfigMap
+metadata:
+  name: settings
+`)
+}
+
+func TestPatchTransformerGroup(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	input := `
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: web
+  labels:
+    app: web
+---
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: web
+  labels:
+    app: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    app: web
+`
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  labelSelector: app=web
+patch: '[{"op": "add", "path": "/metadata/labels/tier", "value": "frontend"}]'
+group: networking.k8s.io
+`)))
+	m := makeResMap(t, th, input)
+	require.NoError(t, p.Transform(m))
+	m.RemoveBuildAnnotations()
+	yml, err := m.AsYaml()
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  labels:
+    app: web
+    tier: frontend
+  name: web
+---
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  labels:
+    app: web
+    tier: frontend
+  name: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    app: web
+  name: web
+`, string(yml))
+	require.Equal(t, map[resid.ResId]string{
+		resid.NewResId(resid.NewGvk("", "v1", "Service"), "web"): "group not allowed",
+	}, p.SkippedResources())
+}
+
+// forgetfulRegistry knows the apps kinds only the first time it's asked.
+type forgetfulRegistry struct {
+	asked bool
+}
+
+func (r *forgetfulRegistry) Schema(gvk resid.Gvk) *openapi.ResourceSchema {
+	if r.asked {
+		return nil
+	}
+	r.asked = true
+	return appsRegistry{}.Schema(gvk)
+}
+
+func TestPatchTransformerAssertDeterministic(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+options:
+  assertDeterministic: true
+patch: |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web0
+  spec:
+    replicas: 3
+`
+	th.RunTransformerAndCheckResult(config, manyDeployments(1), `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web0
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - image: nginx
+        name: web
+`)
+
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(config)))
+	p.SetSchemaRegistry(&forgetfulRegistry{})
+	m := makeResMap(t, th, manyDeployments(1))
+	err := p.Transform(m)
+	require.ErrorContains(t, err, "isn't deterministic: applied twice to the same input, it failed only once")
+	yml, err := m.AsYaml()
+	require.NoError(t, err)
+	require.Contains(t, string(yml), "replicas: 1\n")
+}
+
+func TestPatchTransformerPatchFileEncoding(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+path: patch.json
+target:
+  kind: Deployment
+`
+	th.WriteF("patch.json", "\ufeff"+`[{"op": "replace", "path": "/spec/replicas", "value": 3}]`)
+	th.RunTransformerAndCheckResult(config, manyDeployments(1), `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web0
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - image: nginx
+        name: web
+`)
+
+	th.WriteF("patch.json", `[{"op": "replace", "path": "/metadata/name", "value": "caf`+"\xe9"+`"}]`)
+	require.ErrorContains(t, th.ErrorFromLoadAndRunTransformer(config, manyDeployments(1)),
+		"the patch file from path(patch.json) isn't valid UTF-8: invalid byte at offset 58")
+}
+
+func TestPatchTransformerRequireOwnerLabel(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: Deployment
+patch: '[{"op": "replace", "path": "/spec/replicas", "value": 3}]'
+requireOwnerLabel: team
+`
+	th.RunTransformerAndCheckResult(config, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    team: payments
+spec:
+  replicas: 1
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    team: payments
+  name: web
+spec:
+  replicas: 3
+`)
+	th.RunTransformerAndCheckError(config, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    team: payments
+spec:
+  replicas: 1
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: worker
+  labels:
+    team: ""
+spec:
+  replicas: 1
+`, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err, `Deployment worker has no owner label "team" after applying patch`)
+	})
+}
+
+func TestPatchTransformerEnvironment(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.WriteF("patch.yaml", `
+dev:
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web0
+  spec:
+    replicas: 1
+prod:
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web0
+  spec:
+    replicas: 5
+    template:
+      spec:
+        containers:
+        - name: web
+          image: nginx:1.27
+`)
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+path: patch.yaml
+environment: %s
+`
+	th.RunTransformerAndCheckResult(fmt.Sprintf(config, "prod"), manyDeployments(1), `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web0
+spec:
+  replicas: 5
+  template:
+    spec:
+      containers:
+      - image: nginx:1.27
+        name: web
+`)
+
+	require.ErrorContains(t, th.ErrorFromLoadAndRunTransformer(fmt.Sprintf(config, "staging"), manyDeployments(1)),
+		`invalid patch [path: "patch.yaml"]: no section for environment "staging"; expected one of dev, prod`)
+}
+
+func TestPatchTransformerEffectivePatch(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	th.WriteF("patch.yaml", `
+dev:
+  ops:
+  - replace /spec/replicas: 1
+prod:
+  ops:
+  - replace /spec/replicas: 5
+  - remove /metadata/labels/tier:
+`)
+	p := patchtransformer.KustomizePlugin
+	require.NoError(t, p.Config(th.MakePluginHelpers(), []byte(`
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+path: patch.yaml
+environment: prod
+target:
+  kind: Deployment
+options:
+  sortMapKeys: true
+`)))
+	patch, options := p.EffectivePatch()
+	require.JSONEq(t,
+		`[{"op": "replace", "path": "/spec/replicas", "value": 5}, {"op": "remove", "path": "/metadata/labels/tier"}]`,
+		patch)
+	require.Equal(t, map[string]bool{"sortMapKeys": true, "perDocument": true}, options)
+
+	options["perDocument"] = false
+	_, options = p.EffectivePatch()
+	require.True(t, options["perDocument"])
+}
+
+func TestPatchTransformerAllowApiVersionChange(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarness(t).
+		PrepBuiltin("PatchTransformer")
+	defer th.Reset()
+
+	config := `
+apiVersion: builtin
+kind: PatchTransformer
+metadata:
+  name: notImportantHere
+target:
+  kind: HorizontalPodAutoscaler
+options:
+  allowApiVersionChange: %t
+patch: |-
+  apiVersion: autoscaling/v2
+  kind: HorizontalPodAutoscaler
+  metadata:
+    name: web
+  spec:
+    maxReplicas: 10
+`
+	input := `
+apiVersion: autoscaling/v1
+kind: HorizontalPodAutoscaler
+metadata:
+  name: web
+spec:
+  maxReplicas: 5
+`
+	th.RunTransformerAndCheckError(fmt.Sprintf(config, false), input, func(t *testing.T, err error) {
+		t.Helper()
+		require.ErrorContains(t, err,
+			"has apiVersion autoscaling/v2, but targets HorizontalPodAutoscaler web of apiVersion autoscaling/v1; "+
+				"set option allowApiVersionChange to change the apiVersion")
+	})
+	th.RunTransformerAndCheckResult(fmt.Sprintf(config, true), input, `
+apiVersion: autoscaling/v2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: web
+spec:
+  maxReplicas: 10
+`)
+}